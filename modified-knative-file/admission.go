@@ -0,0 +1,138 @@
+// 基于预测积压量的准入控制：积压量按预计执行时间而不是请求个数来算（排队中的加上在途的），
+// 平摊到每个pod上超过阈值时，提前拒绝（带Retry-After）或者暂缓大任务/低优先级任务，
+// 而不是等到队列塞满40000个请求、再在activator里超时。策略可以按revision通过注解选择
+
+package shared
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// revision上用于选择准入策略的注解
+const AdmissionAnnotationKey = "slb.knative.dev/admission"
+
+// 请求上下文中存放准入策略名的键，由handler根据revision注解放进去
+const AdmissionPolicyKey ContextKey = "admissionPolicy"
+
+type AdmissionPolicy struct {
+	MaxBacklogPerPod float64       // 每个pod平摊的积压量上限（毫秒），超过后开始拒绝大任务和低优先级任务，0表示不限制
+	HardBacklogRatio float64       // 积压量超过MaxBacklogPerPod的这么多倍时，所有任务都拒绝
+	LargeGroup       int           // 组下标不小于它的算大任务
+	DeferTimeout     time.Duration // 大于0时先暂缓这么久，等积压量降下来，还是不行再拒绝
+}
+
+var admissionPolicies = map[string]AdmissionPolicy{
+	"none":       {},
+	"shed-large": {MaxBacklogPerPod: 60000, HardBacklogRatio: 3, LargeGroup: 7},
+	"defer-large": {MaxBacklogPerPod: 60000, HardBacklogRatio: 3, LargeGroup: 7,
+		DeferTimeout: 10 * time.Second},
+	"shed-all": {MaxBacklogPerPod: 60000, HardBacklogRatio: 1, LargeGroup: 0},
+}
+
+// 没有在revision上指定时使用的策略，由main.go根据环境变量ADMISSION_POLICY设置
+var DefaultAdmissionPolicy = "none"
+
+// 每个revision排队中（还没发给pod）的任务的预计执行时间之和（毫秒）
+var (
+	queuedWorkMutex sync.Mutex
+	queuedWork      = make(map[string]float64)
+
+	ShedJobNum     = 0 // 被准入控制拒绝的请求数
+	DeferredJobNum = 0 // 被暂缓过的请求数
+)
+
+func addQueuedWork(rev string, work float64) {
+	queuedWorkMutex.Lock()
+	defer queuedWorkMutex.Unlock()
+	queuedWork[rev] += work
+}
+
+// rev为空时返回所有revision之和
+func QueuedWork(rev string) float64 {
+	queuedWorkMutex.Lock()
+	defer queuedWorkMutex.Unlock()
+	if rev != "" {
+		return queuedWork[rev]
+	}
+	total := 0.0
+	for _, work := range queuedWork {
+		total += work
+	}
+	return total
+}
+
+// revision的每个pod平摊的积压量：排队中的、在途的，再加上这个新任务自己
+func BacklogPerPod(rev string, work float64) float64 {
+	pods := max(GetPodNum(rev), 1)
+	return (QueuedWork(rev) + InflightWork(rev) + work) / float64(pods)
+}
+
+func lookupAdmissionPolicy(r *http.Request) AdmissionPolicy {
+	name, _ := r.Context().Value(AdmissionPolicyKey).(string)
+	if name == "" {
+		name = DefaultAdmissionPolicy
+	}
+	return admissionPolicies[name]
+}
+
+// 判断一个请求要不要被拒绝。小任务且优先级不低的，只有积压量超过硬上限才拒绝
+func (p AdmissionPolicy) shouldShed(r *http.Request, backlog float64) bool {
+	if p.MaxBacklogPerPod <= 0 || backlog <= p.MaxBacklogPerPod {
+		return false
+	}
+	if backlog > p.MaxBacklogPerPod*p.HardBacklogRatio {
+		return true
+	}
+	rate, _ := strconv.Atoi(r.Header.Get("X-Rate"))
+	return GetGroupIndex(rate) >= p.LargeGroup || r.Header.Get("X-Priority") == "low"
+}
+
+// 准入检查，不接受时写503和Retry-After并返回false
+func Admit(w http.ResponseWriter, r *http.Request) bool {
+	p := lookupAdmissionPolicy(r)
+	rate, _ := strconv.Atoi(r.Header.Get("X-Rate"))
+	work := ExpectedExecTime(rate)
+	rev := RevisionFrom(r.Context())
+
+	backlog := BacklogPerPod(rev, work)
+	if !p.shouldShed(r, backlog) {
+		return true
+	}
+
+	// 暂缓：隔一段时间再看看积压量有没有降下来
+	if p.DeferTimeout > 0 {
+		GlobalVarMutex.Lock()
+		DeferredJobNum++
+		GlobalVarMutex.Unlock()
+		deadline := time.Now().Add(p.DeferTimeout)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for time.Now().Before(deadline) {
+			select {
+			case <-r.Context().Done():
+				// 客户端断开或者请求的截止时间先到了，也要给个回复，否则HandlerFunc返回时会是空的200
+				http.Error(w, "activator overloaded, request deferred until cancelled", http.StatusServiceUnavailable)
+				return false
+			case <-ticker.C:
+			}
+			backlog = BacklogPerPod(rev, work)
+			if !p.shouldShed(r, backlog) {
+				return true
+			}
+		}
+	}
+
+	GlobalVarMutex.Lock()
+	ShedJobNum++
+	GlobalVarMutex.Unlock()
+
+	// 按超出的积压量估计多久之后再来比较合适
+	retryAfter := int(math.Ceil((backlog - p.MaxBacklogPerPod) / 1000))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	http.Error(w, "activator overloaded, request shed", http.StatusServiceUnavailable)
+	return false
+}
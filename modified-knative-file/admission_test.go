@@ -0,0 +1,34 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmitDeferCancelledWrites503(t *testing.T) {
+	const rev = "default/alu-bench-00001"
+	admissionPolicies["test-defer"] = AdmissionPolicy{MaxBacklogPerPod: 1, HardBacklogRatio: 1, DeferTimeout: time.Minute}
+	addQueuedWork(rev, 1000)
+	t.Cleanup(func() {
+		delete(admissionPolicies, "test-defer")
+		addQueuedWork(rev, -1000)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ctx = context.WithValue(ctx, RevisionKey, rev)
+	ctx = context.WithValue(ctx, AdmissionPolicyKey, "test-defer")
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	r.Header.Set("X-Rate", "100")
+	w := httptest.NewRecorder()
+
+	if Admit(w, r) {
+		t.Fatal("Admit() = true, want false while the backlog stays over the limit")
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,303 @@
+// 到达过程：GetRandIAT用截断的正态分布，CV大的时候大量负值被丢掉，实际的均值偏大、CV偏小；
+// locust用的是齐次泊松过程，没有突发也没有昼夜变化。这里提供几种到达过程，都按“下一个到达间隔（毫秒）”来取：
+//   - poisson：齐次泊松过程
+//   - gamma：间隔服从gamma分布，按均值和CV参数化，CV=1就是泊松，CV>1更突发，CV<1更均匀
+//   - mmpp：马尔可夫调制泊松过程，在几个速率之间切换，每个状态的停留时间服从指数分布
+//   - onoff：突发，on期间按给定速率到达，off期间没有请求，是两状态mmpp的特例
+//   - diurnal：速率按正弦变化的非齐次泊松过程，用来模拟昼夜的负载起伏
+// real-world的sequence循环和负载生成器都可以用
+
+package shared
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 一个到达过程，有内部的时钟和状态，不能并发使用
+type ArrivalProcess interface {
+	// 下一个到达间隔（毫秒）
+	NextIAT() float64
+}
+
+type poissonArrival struct {
+	rnd  *rand.Rand
+	rate float64 // 每毫秒的到达数
+}
+
+func NewPoissonArrival(rnd *rand.Rand, ratePerSecond float64) ArrivalProcess {
+	return &poissonArrival{rnd: rnd, rate: ratePerSecond / 1000}
+}
+
+func (p *poissonArrival) NextIAT() float64 {
+	return p.rnd.ExpFloat64() / p.rate
+}
+
+// 形状参数为shape、尺度为1的gamma分布，Marsaglia-Tsang方法；shape<1时先按shape+1采样再修正
+func sampleGamma(shape float64, uniform func() float64, normal func() float64) float64 {
+	if shape < 1 {
+		return sampleGamma(shape+1, uniform, normal) * math.Pow(uniform(), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := normal()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := uniform()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// 均值为mean、变异系数为cv的gamma分布采样：shape=1/cv²，scale=mean*cv²。cv<=0时就是定值mean
+func gammaIAT(mean float64, cv float64, uniform func() float64, normal func() float64) float64 {
+	if cv <= 0 {
+		return mean
+	}
+	shape := 1 / (cv * cv)
+	return sampleGamma(shape, uniform, normal) * mean / shape
+}
+
+// 和GetRandIAT参数一样，但不需要截断，均值和CV都是准的
+func GetGammaIAT(avgIAT float64, cv float64) float64 {
+	return gammaIAT(avgIAT, cv, rand.Float64, rand.NormFloat64)
+}
+
+type gammaArrival struct {
+	rnd  *rand.Rand
+	mean float64
+	cv   float64
+}
+
+// meanIAT的单位是毫秒
+func NewGammaArrival(rnd *rand.Rand, meanIAT float64, cv float64) ArrivalProcess {
+	return &gammaArrival{rnd: rnd, mean: meanIAT, cv: cv}
+}
+
+func (p *gammaArrival) NextIAT() float64 {
+	return gammaIAT(p.mean, p.cv, p.rnd.Float64, p.rnd.NormFloat64)
+}
+
+type MMPPState struct {
+	RatePerSecond float64       // 这个状态下的到达速率，0表示没有请求
+	MeanDuration  time.Duration // 平均停留时间，实际停留时间服从指数分布
+}
+
+type mmppArrival struct {
+	rnd       *rand.Rand
+	states    []MMPPState
+	cur       int
+	remaining float64 // 当前状态还要停留多久（毫秒）
+}
+
+// 从第一个状态开始，离开一个状态时等概率切到其他任一状态（两个状态时就是来回切换）
+func NewMMPPArrival(rnd *rand.Rand, states []MMPPState) ArrivalProcess {
+	p := &mmppArrival{rnd: rnd, states: states}
+	p.remaining = p.sojourn()
+	return p
+}
+
+func (p *mmppArrival) sojourn() float64 {
+	return p.rnd.ExpFloat64() * float64(p.states[p.cur].MeanDuration) / float64(time.Millisecond)
+}
+
+func (p *mmppArrival) NextIAT() float64 {
+	iat := 0.0
+	for {
+		// 指数分布无记忆，切换状态后重新采样是对的
+		rate := p.states[p.cur].RatePerSecond / 1000
+		if rate > 0 {
+			if next := p.rnd.ExpFloat64() / rate; next < p.remaining {
+				p.remaining -= next
+				return iat + next
+			}
+		}
+		iat += p.remaining
+		if len(p.states) > 1 {
+			next := p.rnd.Intn(len(p.states) - 1)
+			if next >= p.cur {
+				next++
+			}
+			p.cur = next
+		}
+		p.remaining = p.sojourn()
+	}
+}
+
+// on期间按ratePerSecond到达，on和off的平均时长分别是onMean和offMean
+func NewOnOffArrival(rnd *rand.Rand, ratePerSecond float64, onMean time.Duration, offMean time.Duration) ArrivalProcess {
+	return NewMMPPArrival(rnd, []MMPPState{
+		{RatePerSecond: ratePerSecond, MeanDuration: onMean},
+		{RatePerSecond: 0, MeanDuration: offMean},
+	})
+}
+
+type diurnalArrival struct {
+	rnd       *rand.Rand
+	mean      float64 // 每毫秒的平均到达数
+	amplitude float64
+	period    float64 // 毫秒
+	phase     float64
+	now       float64 // 从开始算起的时刻（毫秒）
+}
+
+// 速率为meanPerSecond*(1+amplitude*sin(2π(t+phase)/period))，amplitude在0到1之间；
+// phase为0时从平均速率开始往上走，phase为period*3/4时从低谷开始
+func NewDiurnalArrival(rnd *rand.Rand, meanPerSecond float64, amplitude float64, period time.Duration, phase time.Duration) ArrivalProcess {
+	return &diurnalArrival{
+		rnd:       rnd,
+		mean:      meanPerSecond / 1000,
+		amplitude: math.Max(0, math.Min(1, amplitude)),
+		period:    float64(period) / float64(time.Millisecond),
+		phase:     float64(phase) / float64(time.Millisecond),
+	}
+}
+
+func (p *diurnalArrival) rateAt(t float64) float64 {
+	return p.mean * (1 + p.amplitude*math.Sin(2*math.Pi*(t+p.phase)/p.period))
+}
+
+// 按最大速率产生候选到达，再按当前速率和最大速率之比接受（thinning）
+func (p *diurnalArrival) NextIAT() float64 {
+	maxRate := p.mean * (1 + p.amplitude)
+	start := p.now
+	for {
+		p.now += p.rnd.ExpFloat64() / maxRate
+		if p.rnd.Float64()*maxRate <= p.rateAt(p.now) {
+			return p.now - start
+		}
+	}
+}
+
+// 解析到达过程的配置，格式是"种类:参数=值,参数=值"，多个值用/隔开，速率的单位是每秒，时长用Go的写法：
+//
+//	poisson:rate=10
+//	gamma:mean=100,cv=3             （mean是平均间隔，毫秒）
+//	mmpp:rates=5/50,durations=30s/5s
+//	onoff:rate=50,on=2s,off=10s
+//	diurnal:rate=10,amplitude=0.8,period=24h,phase=18h
+func ParseArrivalProcess(spec string, rnd *rand.Rand) (ArrivalProcess, error) {
+	kind, rest, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	params := make(map[string]string)
+	for _, kv := range strings.Split(rest, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(kv), "="); ok {
+			params[k] = v
+		}
+	}
+	var err error
+	// def为空表示必须给出
+	value := func(key string, def string) string {
+		v, ok := params[key]
+		if !ok {
+			v = def
+		}
+		if v == "" && err == nil {
+			err = fmt.Errorf("arrival process %q: missing %s", kind, key)
+		}
+		return v
+	}
+	float := func(key string, def string) float64 {
+		v := value(key, def)
+		f, perr := strconv.ParseFloat(v, 64)
+		if v != "" && err == nil && (perr != nil || f < 0) {
+			err = fmt.Errorf("arrival process %q: bad %s %q", kind, key, v)
+		}
+		return f
+	}
+	duration := func(key string, def string) time.Duration {
+		v := value(key, def)
+		d, perr := time.ParseDuration(v)
+		if v != "" && err == nil && (perr != nil || d < 0) {
+			err = fmt.Errorf("arrival process %q: bad %s %q", kind, key, v)
+		}
+		return d
+	}
+	positive := func(key string, x float64) {
+		if x <= 0 && err == nil {
+			err = fmt.Errorf("arrival process %q: %s must be positive", kind, key)
+		}
+	}
+
+	var p ArrivalProcess
+	switch kind {
+	case "poisson":
+		rate := float("rate", "")
+		positive("rate", rate)
+		p = NewPoissonArrival(rnd, rate)
+	case "gamma":
+		mean := float("mean", "")
+		positive("mean", mean)
+		p = NewGammaArrival(rnd, mean, float("cv", "1"))
+	case "onoff":
+		rate, on, off := float("rate", ""), duration("on", ""), duration("off", "")
+		positive("rate", rate)
+		positive("on", float64(on))
+		positive("off", float64(off))
+		p = NewOnOffArrival(rnd, rate, on, off)
+	case "diurnal":
+		rate, period := float("rate", ""), duration("period", "24h")
+		positive("rate", rate)
+		positive("period", float64(period))
+		p = NewDiurnalArrival(rnd, rate, float("amplitude", "0.5"), period, duration("phase", "0s"))
+	case "mmpp":
+		rates := strings.Split(value("rates", ""), "/")
+		durations := strings.Split(value("durations", ""), "/")
+		if err == nil && len(rates) != len(durations) {
+			err = fmt.Errorf("arrival process %q: rates and durations must have the same number of states", kind)
+		}
+		states := make([]MMPPState, len(rates))
+		maxRate := 0.0
+		for i := range states {
+			if err != nil {
+				break
+			}
+			params["rate"], params["duration"] = rates[i], durations[i]
+			states[i] = MMPPState{RatePerSecond: float("rate", ""), MeanDuration: duration("duration", "")}
+			positive("duration", float64(states[i].MeanDuration))
+			maxRate = math.Max(maxRate, states[i].RatePerSecond)
+		}
+		// 所有状态的速率都是0的话永远等不到下一个请求
+		positive("rates", maxRate)
+		p = NewMMPPArrival(rnd, states)
+	default:
+		return nil, fmt.Errorf("unknown arrival process %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// real-world的sequence里action之间的间隔用什么分布：默认"gamma"，按给定的均值和CV采样，两者都是准的；
+// "normal"是原来的截断正态分布（CV大时均值偏大、CV偏小），复现旧实验时用。由main.go根据环境变量SEQ_IAT_DIST设置
+var SeqIATDistribution = "gamma"
+
+func GetSeqIAT(avgIAT float64, cv float64) float64 {
+	if SeqIATDistribution == "normal" {
+		return GetRandIAT(avgIAT, cv)
+	}
+	return GetGammaIAT(avgIAT, cv)
+}
+
+// 从0开始按到达过程生成到达时刻，直到d为止
+func ArrivalTimes(p ArrivalProcess, d time.Duration) []time.Duration {
+	var times []time.Duration
+	now := 0.0
+	limit := float64(d) / float64(time.Millisecond)
+	for {
+		now += p.NextIAT()
+		if now >= limit {
+			return times
+		}
+		times = append(times, time.Duration(now*float64(time.Millisecond)))
+	}
+}
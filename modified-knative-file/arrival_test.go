@@ -0,0 +1,144 @@
+package shared
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// n个间隔的均值和变异系数
+func iatStats(p ArrivalProcess, n int) (mean float64, cv float64) {
+	var sum, sumSq float64
+	for i := 0; i < n; i++ {
+		x := p.NextIAT()
+		sum += x
+		sumSq += x * x
+	}
+	mean = sum / float64(n)
+	return mean, math.Sqrt(sumSq/float64(n)-mean*mean) / mean
+}
+
+func within(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance*want
+}
+
+// gamma和泊松的间隔按给定的均值和CV分布，不像截断正态分布那样CV大了就不准
+func TestArrivalMeanAndCV(t *testing.T) {
+	tests := []struct {
+		name     string
+		p        ArrivalProcess
+		mean, cv float64
+	}{
+		{"poisson", NewPoissonArrival(rand.New(rand.NewSource(1)), 10), 100, 1},
+		{"gamma cv=0.5", NewGammaArrival(rand.New(rand.NewSource(1)), 100, 0.5), 100, 0.5},
+		{"gamma cv=3", NewGammaArrival(rand.New(rand.NewSource(1)), 100, 3), 100, 3},
+		{"gamma cv=0", NewGammaArrival(rand.New(rand.NewSource(1)), 100, 0), 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mean, cv := iatStats(tt.p, 200000)
+			if !within(mean, tt.mean, 0.03) {
+				t.Errorf("mean = %v, want %v", mean, tt.mean)
+			}
+			if math.Abs(cv-tt.cv) > 0.05*math.Max(tt.cv, 1) {
+				t.Errorf("cv = %v, want %v", cv, tt.cv)
+			}
+		})
+	}
+}
+
+// 长时间下来，onoff、mmpp和diurnal的到达数等于按停留时间或者一个周期加权的平均速率
+func TestArrivalEffectiveRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       ArrivalProcess
+		horizon time.Duration
+		rate    float64 // 每秒
+	}{{
+		name:    "onoff",
+		p:       NewOnOffArrival(rand.New(rand.NewSource(1)), 50, 2*time.Second, 8*time.Second),
+		horizon: 50000 * time.Second,
+		rate:    50 * 2.0 / 10,
+	}, {
+		name: "mmpp",
+		p: NewMMPPArrival(rand.New(rand.NewSource(1)), []MMPPState{
+			{RatePerSecond: 5, MeanDuration: 30 * time.Second},
+			{RatePerSecond: 50, MeanDuration: 5 * time.Second},
+		}),
+		horizon: 50000 * time.Second,
+		rate:    (5*30 + 50*5) / 35.0,
+	}, {
+		name:    "diurnal",
+		p:       NewDiurnalArrival(rand.New(rand.NewSource(1)), 10, 0.8, 100*time.Second, 0),
+		horizon: 10000 * time.Second,
+		rate:    10,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := float64(len(ArrivalTimes(tt.p, tt.horizon))) / tt.horizon.Seconds()
+			if !within(got, tt.rate, 0.05) {
+				t.Errorf("effective rate = %v/s, want %v/s", got, tt.rate)
+			}
+		})
+	}
+}
+
+// 昼夜变化的速率在波峰附近明显高于波谷附近
+func TestDiurnalFollowsSine(t *testing.T) {
+	period := 100 * time.Second
+	p := NewDiurnalArrival(rand.New(rand.NewSource(1)), 10, 0.8, period, 0)
+	var peak, trough int
+	for _, at := range ArrivalTimes(p, 100*period) {
+		switch phase := at % period; {
+		case phase >= 20*time.Second && phase < 30*time.Second:
+			peak++
+		case phase >= 70*time.Second && phase < 80*time.Second:
+			trough++
+		}
+	}
+	if peak < 5*trough {
+		t.Errorf("arrivals near the peak = %d, near the trough = %d, want a clear difference", peak, trough)
+	}
+}
+
+func TestParseArrivalProcess(t *testing.T) {
+	for _, spec := range []string{
+		"poisson:rate=10",
+		"gamma:mean=100,cv=3",
+		"gamma:mean=100",
+		"mmpp:rates=5/50,durations=30s/5s",
+		"mmpp:rates=0/50,durations=30s/5s",
+		"onoff:rate=50,on=2s,off=10s",
+		"diurnal:rate=10,amplitude=0.8,period=24h,phase=18h",
+		"diurnal:rate=10",
+	} {
+		if _, err := ParseArrivalProcess(spec, rand.New(rand.NewSource(1))); err != nil {
+			t.Errorf("ParseArrivalProcess(%q) = %v", spec, err)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"weibull:rate=10",
+		"poisson",
+		"poisson:rate=",
+		"poisson:rate=abc",
+		"poisson:rate=-1",
+		"poisson:rate=0",
+		"gamma:cv=3",
+		"gamma:mean=100,cv=-1",
+		"onoff:rate=50,on=2s",
+		"onoff:rate=50,on=0s,off=10s",
+		"onoff:rate=50,on=2x,off=10s",
+		"diurnal:rate=10,period=0s",
+		"mmpp:rates=5/50,durations=30s",
+		"mmpp:rates=0/0,durations=30s/5s",
+		"mmpp:rates=5/50,durations=30s/0s",
+		"mmpp:durations=30s/5s",
+	} {
+		if p, err := ParseArrivalProcess(spec, rand.New(rand.NewSource(1))); err == nil {
+			t.Errorf("ParseArrivalProcess(%q) = %T, want an error", spec, p)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Azure Functions公开数据集（AzureFunctionsDataset2019）的回放：real-world模式原来只从汇总好的CDF里采样，
+// 这里直接读每个函数每分钟的调用次数（invocations_per_function_md.anon.dXX.csv）和
+// 每个函数的执行时间分布（function_durations_percentiles.anon.dXX.csv），按原样生成调用序列。
+// 数据集只精确到分钟，一分钟内的调用时刻在这一分钟里均匀随机摆放
+
+package shared
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type TraceOptions struct {
+	StartMinute    int     // 回放的分钟区间[StartMinute, EndMinute)，从0开始
+	EndMinute      int     // 0表示到trace的最后一分钟
+	TimeScale      float64 // 时间压缩倍数：trace里的1分钟回放时只持续1/TimeScale分钟，0按1算
+	Functions      int     // 只随机取这么多个函数，0表示全部
+	MinInvocations int     // 区间内调用次数少于它的函数不参与采样
+	DurationScale  float64 // 执行时间乘以这个系数，0按1算
+	UseAverage     bool    // 执行时间一律用平均值，否则按百分位数插值采样
+	Seed           int64   // 采样函数、摆放调用时刻和采样执行时间用的随机种子，相同的种子生成相同的序列
+}
+
+type TraceFunction struct {
+	Owner    string
+	App      string
+	Function string
+	Trigger  string
+	Counts   []int // 每分钟的调用次数
+
+	Average     float64    // 平均执行时间（毫秒）
+	Percentiles [7]float64 // 执行时间的0、1、25、50、75、99、100百分位数（毫秒）
+}
+
+func (f *TraceFunction) Key() string {
+	return f.Owner + "/" + f.App + "/" + f.Function
+}
+
+// 数据集里给出的百分位数，和Percentiles一一对应
+var tracePercentilePoints = [7]float64{0, 0.01, 0.25, 0.50, 0.75, 0.99, 1}
+var tracePercentileColumns = [7]string{
+	"percentile_Average_0", "percentile_Average_1", "percentile_Average_25", "percentile_Average_50",
+	"percentile_Average_75", "percentile_Average_99", "percentile_Average_100",
+}
+
+// 一次调用
+type TraceInvocation struct {
+	At       time.Duration // 相对回放开始的时刻，已经按TimeScale压缩
+	Function string        // TraceFunction.Key()
+	Rate     int           // 执行时间（毫秒），real-world的pod按它执行
+}
+
+// 读CSV的表头，返回列名到下标的映射，缺了需要的列就报错
+func readTraceHeader(reader *csv.Reader, path string, required ...string) ([]string, map[string]int, error) {
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading header of %s: %w", path, err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, fmt.Errorf("%s has no column %q", path, name)
+		}
+	}
+	return header, columns, nil
+}
+
+// 读调用次数和执行时间两个文件，只保留两边都有的函数
+func LoadAzureTrace(invocationsPath string, durationsPath string) ([]*TraceFunction, error) {
+	durations, err := loadTraceDurations(durationsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(invocationsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.ReuseRecord = true
+	header, columns, err := readTraceHeader(reader, invocationsPath, "HashOwner", "HashApp", "HashFunction", "Trigger")
+	if err != nil {
+		return nil, err
+	}
+	// 分钟列的列名是1到1440
+	var minuteColumns []int
+	for i, name := range header {
+		if _, err := strconv.Atoi(name); err == nil {
+			minuteColumns = append(minuteColumns, i)
+		}
+	}
+	sort.Slice(minuteColumns, func(i, j int) bool {
+		a, _ := strconv.Atoi(header[minuteColumns[i]])
+		b, _ := strconv.Atoi(header[minuteColumns[j]])
+		return a < b
+	})
+
+	var fns []*TraceFunction
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", invocationsPath, err)
+		}
+		fn := &TraceFunction{
+			Owner:    record[columns["HashOwner"]],
+			App:      record[columns["HashApp"]],
+			Function: record[columns["HashFunction"]],
+			Trigger:  record[columns["Trigger"]],
+			Counts:   make([]int, len(minuteColumns)),
+		}
+		d, ok := durations[fn.Key()]
+		if !ok {
+			continue
+		}
+		fn.Average, fn.Percentiles = d.Average, d.Percentiles
+		for i, col := range minuteColumns {
+			fn.Counts[i], _ = strconv.Atoi(record[col])
+		}
+		fns = append(fns, fn)
+	}
+	return fns, nil
+}
+
+func loadTraceDurations(path string) (map[string]*TraceFunction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	required := append([]string{"HashOwner", "HashApp", "HashFunction", "Average"}, tracePercentileColumns[:]...)
+	_, columns, err := readTraceHeader(reader, path, required...)
+	if err != nil {
+		return nil, err
+	}
+
+	durations := make(map[string]*TraceFunction)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		d := &TraceFunction{
+			Owner:    record[columns["HashOwner"]],
+			App:      record[columns["HashApp"]],
+			Function: record[columns["HashFunction"]],
+		}
+		d.Average, _ = strconv.ParseFloat(record[columns["Average"]], 64)
+		for i, name := range tracePercentileColumns {
+			d.Percentiles[i], _ = strconv.ParseFloat(record[columns[name]], 64)
+		}
+		durations[d.Key()] = d
+	}
+	return durations, nil
+}
+
+// 按百分位数分段线性插值，采样一次执行时间（毫秒）
+func (f *TraceFunction) SampleDuration(rnd *rand.Rand) float64 {
+	u := rnd.Float64()
+	for i := 1; i < len(tracePercentilePoints); i++ {
+		if u <= tracePercentilePoints[i] {
+			lo, hi := tracePercentilePoints[i-1], tracePercentilePoints[i]
+			return f.Percentiles[i-1] + (u-lo)/(hi-lo)*(f.Percentiles[i]-f.Percentiles[i-1])
+		}
+	}
+	return f.Percentiles[len(f.Percentiles)-1]
+}
+
+// 按opts截取分钟区间、筛选和抽样函数，生成按时间排序的调用序列
+func BuildTraceSchedule(fns []*TraceFunction, opts TraceOptions) []TraceInvocation {
+	timeScale := opts.TimeScale
+	if timeScale <= 0 {
+		timeScale = 1
+	}
+	durationScale := opts.DurationScale
+	if durationScale <= 0 {
+		durationScale = 1
+	}
+	rnd := rand.New(rand.NewSource(opts.Seed))
+
+	inRange := func(fn *TraceFunction) []int {
+		end := len(fn.Counts)
+		if opts.EndMinute > 0 && opts.EndMinute < end {
+			end = opts.EndMinute
+		}
+		if opts.StartMinute >= end {
+			return nil
+		}
+		return fn.Counts[opts.StartMinute:end]
+	}
+
+	var candidates []*TraceFunction
+	for _, fn := range fns {
+		total := 0
+		for _, c := range inRange(fn) {
+			total += c
+		}
+		if total > 0 && total >= opts.MinInvocations {
+			candidates = append(candidates, fn)
+		}
+	}
+	if opts.Functions > 0 && opts.Functions < len(candidates) {
+		rnd.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+		candidates = candidates[:opts.Functions]
+	}
+
+	var schedule []TraceInvocation
+	for _, fn := range candidates {
+		key := fn.Key()
+		for minute, count := range inRange(fn) {
+			for k := 0; k < count; k++ {
+				at := time.Duration(minute)*time.Minute + time.Duration(rnd.Int63n(int64(time.Minute)))
+				duration := fn.Average
+				if !opts.UseAverage {
+					duration = fn.SampleDuration(rnd)
+				}
+				schedule = append(schedule, TraceInvocation{
+					At:       time.Duration(float64(at) / timeScale),
+					Function: key,
+					Rate:     max(1, int(math.Round(duration*durationScale))),
+				})
+			}
+		}
+	}
+	sort.SliceStable(schedule, func(i, j int) bool { return schedule[i].At < schedule[j].At })
+	return schedule
+}
+
+// 按调用序列里的时刻依次调用fire，序列发完或者ctx结束时返回。
+// fire不能阻塞，否则后面的调用都会被拖后，发请求应该另起goroutine
+func ReplayTrace(ctx context.Context, schedule []TraceInvocation, fire func(TraceInvocation)) error {
+	start := time.Now()
+	for _, inv := range schedule {
+		if d := time.Until(start.Add(inv.At)); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		fire(inv)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package shared
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 和数据集同样格式的两个小文件：f3没有执行时间，f4没有调用次数，都不会被读进来。分钟列故意不按顺序
+const (
+	testInvocationsCSV = `HashOwner,HashApp,HashFunction,Trigger,1,3,2,4
+o1,a1,f1,http,1,2,0,0
+o1,a1,f2,timer,0,0,3,1
+o2,a2,f3,queue,5,5,5,5
+`
+	testDurationsCSV = `HashOwner,HashApp,HashFunction,Average,Count,Minimum,Maximum,percentile_Average_0,percentile_Average_1,percentile_Average_25,percentile_Average_50,percentile_Average_75,percentile_Average_99,percentile_Average_100
+o1,a1,f1,10,3,1,100,1,2,5,10,20,50,100
+o1,a1,f2,100,4,100,100,100,100,100,100,100,100,100
+o3,a3,f4,7,1,7,7,7,7,7,7,7,7,7
+`
+)
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadTestTrace(t *testing.T) []*TraceFunction {
+	t.Helper()
+	fns, err := LoadAzureTrace(writeTestFile(t, "invocations.csv", testInvocationsCSV), writeTestFile(t, "durations.csv", testDurationsCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fns
+}
+
+func TestLoadAzureTrace(t *testing.T) {
+	fns := loadTestTrace(t)
+	if len(fns) != 2 {
+		t.Fatalf("loaded %d functions, want f1 and f2", len(fns))
+	}
+	f1, f2 := fns[0], fns[1]
+	if f1.Key() != "o1/a1/f1" || f1.Trigger != "http" || f2.Key() != "o1/a1/f2" {
+		t.Errorf("functions = %s (%s), %s", f1.Key(), f1.Trigger, f2.Key())
+	}
+	// 分钟列按1到4排好
+	if got := f1.Counts; len(got) != 4 || got[0] != 1 || got[1] != 0 || got[2] != 2 || got[3] != 0 {
+		t.Errorf("f1 counts = %v, want [1 0 2 0]", got)
+	}
+	if f1.Average != 10 || f1.Percentiles != [7]float64{1, 2, 5, 10, 20, 50, 100} {
+		t.Errorf("f1 durations = %v %v", f1.Average, f1.Percentiles)
+	}
+
+	noAverage := strings.Replace(testDurationsCSV, "Average,Count", "Mean,Count", 1)
+	if _, err := LoadAzureTrace(writeTestFile(t, "invocations.csv", testInvocationsCSV), writeTestFile(t, "durations.csv", noAverage)); err == nil {
+		t.Error("durations without the Average column were accepted")
+	}
+}
+
+func TestBuildTraceSchedule(t *testing.T) {
+	fns := loadTestTrace(t)
+
+	t.Run("minute window and time scale", func(t *testing.T) {
+		// 第2、3分钟：f1调用2次（第3分钟），f2调用3次（第2分钟）；压缩60倍后一分钟只有1秒
+		schedule := BuildTraceSchedule(fns, TraceOptions{StartMinute: 1, EndMinute: 3, TimeScale: 60, UseAverage: true})
+		count := map[string]int{}
+		for i, inv := range schedule {
+			count[inv.Function]++
+			if i > 0 && inv.At < schedule[i-1].At {
+				t.Fatal("schedule is not sorted by time")
+			}
+			minute := 0
+			if inv.Function == "o1/a1/f1" {
+				minute = 1
+			}
+			if inv.At < time.Duration(minute)*time.Second || inv.At >= time.Duration(minute+1)*time.Second {
+				t.Errorf("%s invoked at %v, want within second %d", inv.Function, inv.At, minute)
+			}
+		}
+		if count["o1/a1/f1"] != 2 || count["o1/a1/f2"] != 3 {
+			t.Errorf("invocations = %v, want f1: 2, f2: 3", count)
+		}
+	})
+
+	t.Run("duration scale", func(t *testing.T) {
+		for _, inv := range BuildTraceSchedule(fns, TraceOptions{UseAverage: true, DurationScale: 0.5}) {
+			want := map[string]int{"o1/a1/f1": 5, "o1/a1/f2": 50}[inv.Function]
+			if inv.Rate != want {
+				t.Errorf("%s rate = %d, want %d", inv.Function, inv.Rate, want)
+			}
+		}
+	})
+
+	t.Run("min invocations", func(t *testing.T) {
+		for _, inv := range BuildTraceSchedule(fns, TraceOptions{MinInvocations: 4}) {
+			if inv.Function != "o1/a1/f2" {
+				t.Errorf("%s has 3 invocations and should have been skipped", inv.Function)
+			}
+		}
+	})
+
+	t.Run("seeded function sampling", func(t *testing.T) {
+		picked := map[string]bool{}
+		for seed := int64(1); seed <= 20; seed++ {
+			opts := TraceOptions{Functions: 1, Seed: seed}
+			first, again := BuildTraceSchedule(fns, opts), BuildTraceSchedule(fns, opts)
+			if len(first) != len(again) {
+				t.Fatalf("seed %d: schedules differ in length", seed)
+			}
+			for i := range first {
+				if first[i] != again[i] {
+					t.Fatalf("seed %d: invocation %d differs: %v vs %v", seed, i, first[i], again[i])
+				}
+				if first[i].Function != first[0].Function {
+					t.Fatalf("seed %d: schedule mixes %s and %s", seed, first[0].Function, first[i].Function)
+				}
+			}
+			picked[first[0].Function] = true
+		}
+		if len(picked) != 2 {
+			t.Errorf("20 seeds picked %v, want both functions", picked)
+		}
+	})
+}
+
+// 采样结果的经验分布在每个给出的百分位点上和数据集一致，两点之间是线性的
+func TestSampleDurationInterpolates(t *testing.T) {
+	fn := &TraceFunction{Percentiles: [7]float64{1, 2, 5, 10, 20, 50, 100}}
+	rnd := rand.New(rand.NewSource(1))
+	const n = 200000
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = fn.SampleDuration(rnd)
+		if samples[i] < 1 || samples[i] > 100 {
+			t.Fatalf("sample %v outside [1, 100]", samples[i])
+		}
+	}
+	for _, tt := range []struct{ x, fraction float64 }{
+		{2, 0.01}, {5, 0.25}, {7.5, 0.375}, {10, 0.50}, {20, 0.75}, {50, 0.99},
+	} {
+		below := 0
+		for _, s := range samples {
+			if s <= tt.x {
+				below++
+			}
+		}
+		if got := float64(below) / n; math.Abs(got-tt.fraction) > 0.01 {
+			t.Errorf("P(duration <= %v) = %v, want %v", tt.x, got, tt.fraction)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// 客户端断开或者超过截止时间（请求上下文被取消）时，把还在自定义队列里排队的请求立即删掉，
+// 已经出队但还没发出的也不再发给pod，免得一个没人要结果的8000单位任务白白占用一个pod
+
+package shared
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	cancelWatchMutex sync.Mutex
+	cancelWatches    = make(map[*Completion]func() bool) // 键是SchedulingUnit.Done，值是停止监听的函数
+
+	CancelledJobNum = 0 // 因客户端取消而没有发给pod的请求数
+)
+
+// 入队时开始监听请求上下文，取消时从队列中删掉
+func watchCancel(ctx context.Context, done *Completion) {
+	stop := context.AfterFunc(ctx, func() {
+		cancelWatchMutex.Lock()
+		delete(cancelWatches, done)
+		cancelWatchMutex.Unlock()
+		cancelQueued(done, ctx.Err())
+	})
+	cancelWatchMutex.Lock()
+	defer cancelWatchMutex.Unlock()
+	cancelWatches[done] = stop
+}
+
+// 出队后停止监听，之后的取消由反向代理自己处理
+func stopWatchCancel(done *Completion) {
+	cancelWatchMutex.Lock()
+	stop, ok := cancelWatches[done]
+	delete(cancelWatches, done)
+	cancelWatchMutex.Unlock()
+	if ok {
+		stop()
+	}
+}
+
+func countCancelled() {
+	GlobalVarMutex.Lock()
+	defer GlobalVarMutex.Unlock()
+	CancelledJobNum++
+}
+
+// 取消是因为超过截止时间的话算超时
+func outcomeOf(err error) Outcome {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return OutcomeTimedOut
+	}
+	return OutcomeCancelled
+}
+
+// 排队中的请求按Done索引，取消时直接找到它所在的队列，不用挨个扫描
+var (
+	queuedIndexMutex sync.Mutex
+	queuedIndex      = make(map[*Completion]*queueEntry)
+)
+
+func indexQueued(done *Completion, entry *queueEntry) {
+	queuedIndexMutex.Lock()
+	defer queuedIndexMutex.Unlock()
+	queuedIndex[done] = entry
+}
+
+func unindexQueued(done *Completion, entry *queueEntry) {
+	queuedIndexMutex.Lock()
+	defer queuedIndexMutex.Unlock()
+	if queuedIndex[done] == entry {
+		delete(queuedIndex, done)
+	}
+}
+
+func lookupQueued(done *Completion) *queueEntry {
+	queuedIndexMutex.Lock()
+	defer queuedIndexMutex.Unlock()
+	return queuedIndex[done]
+}
+
+// 找到Done为done的请求，还在排队的话删掉并完成它，让HandlerFunc返回。
+// 已经被出队的请求不管，dispatchUnit会看到上下文已经结束
+func cancelQueued(done *Completion, err error) {
+	u, ok := removeQueued(done)
+	if !ok {
+		return
+	}
+	countCancelled()
+	addQueuedWork(u.Revision, -u.Work)
+	u.Done.Finish(outcomeOf(err))
+}
+
+func removeQueued(done *Completion) (SchedulingUnit, bool) {
+	for {
+		entry := lookupQueued(done)
+		if entry == nil {
+			return SchedulingUnit{}, false
+		}
+		entry.mu.Lock()
+		if entry.removed {
+			// 查到之后、加锁之前刚被出队，可能已经进了冷启动缓冲区，重新查一次
+			entry.mu.Unlock()
+			continue
+		}
+		u := entry.remove()
+		u.take()
+		entry.mu.Unlock()
+		return u, true
+	}
+}
@@ -0,0 +1,256 @@
+// 从零扩容时的缓冲：throttler的breaker只看endpoint数，自定义队列在breaker外面，冷启动时请求要么在队列里干等，
+// 要么一股脑发出去堵在breaker里，第一个就绪的pod会被所有积压的请求淹没。这里让队列知道revision的容量状态：
+//   - 没有就绪的pod（zero）：出队的请求先缓冲在这里，不发出去
+//   - pod陆续就绪（growing）：按预计执行时间从短到长放出缓冲的请求，在途任务数不超过就绪pod数*ColdStartPerPod
+//   - 一段时间没有新pod就绪（steady）：缓冲的请求全部放出，之后的请求不再经过这里
+// 容量状态按revision分开，由throttler的updateCapacity通过SetReadyBackends更新，没更新过时不缓冲
+
+package shared
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type CapacityState int
+
+const (
+	CapacitySteady CapacityState = iota
+	CapacityZero
+	CapacityGrowing
+)
+
+func (s CapacityState) String() string {
+	switch s {
+	case CapacityZero:
+		return "zero"
+	case CapacityGrowing:
+		return "growing"
+	default:
+		return "steady"
+	}
+}
+
+// 扩容过程中每个就绪的pod同时分到的任务数
+var ColdStartPerPod = 1
+
+// 最后一个pod就绪后这么久没有新pod，就认为扩容结束了
+var ColdStartSettle = 5 * time.Second
+
+type coldItem struct {
+	u     SchedulingUnit
+	index int // 在堆里的下标，取消时用heap.Remove
+}
+
+// 缓冲区里的请求按预计执行时间排序
+type coldHeap []*coldItem
+
+func (h coldHeap) Len() int           { return len(h) }
+func (h coldHeap) Less(i, j int) bool { return h[i].u.Work < h[j].u.Work }
+func (h coldHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *coldHeap) Push(x interface{}) {
+	item := x.(*coldItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *coldHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// 一个revision的容量状态和缓冲区。处于steady、缓冲区为空、也没有放出去的请求时和没有记录一样，会被删掉
+type coldRevision struct {
+	buffer     coldHeap
+	state      CapacityState
+	ready      int // 就绪的pod数
+	lastGrowth time.Time
+	running    int // 从缓冲区放出去、还没完成的请求数
+}
+
+// 调用者需持有coldMutex
+func (c *coldRevision) popLocked() SchedulingUnit {
+	u := heap.Pop(&c.buffer).(*coldItem).u
+	u.take()
+	return u
+}
+
+// 调用者需持有coldMutex
+func (c *coldRevision) settleLocked() {
+	if c.state == CapacityGrowing && time.Since(c.lastGrowth) > ColdStartSettle {
+		c.state = CapacitySteady
+	}
+}
+
+var (
+	coldMutex    sync.Mutex
+	coldStates   = make(map[string]*coldRevision) // revision的namespace/name -> 容量状态
+	coldKick     = make(chan struct{}, 1)
+	releaserOnce sync.Once
+)
+
+// 调用者需持有coldMutex
+func pruneColdLocked(rev string, c *coldRevision) {
+	if c.state == CapacitySteady && c.buffer.Len() == 0 && c.running == 0 && coldStates[rev] == c {
+		delete(coldStates, rev)
+	}
+}
+
+func kickColdReleaser() {
+	select {
+	case coldKick <- struct{}{}:
+	default:
+	}
+}
+
+// throttler在revision就绪的pod数变化时调用
+func SetReadyBackends(rev string, n int) {
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	c := coldStates[rev]
+	if c == nil {
+		if n > 0 {
+			// 平时增加pod不需要缓冲
+			return
+		}
+		c = &coldRevision{}
+		coldStates[rev] = c
+	}
+	switch {
+	case n == 0:
+		c.state = CapacityZero
+	case n > c.ready && c.state != CapacitySteady:
+		// 只有从零开始的扩容才算growing
+		c.state = CapacityGrowing
+		c.lastGrowth = time.Now()
+	}
+	c.ready = n
+	kickColdReleaser()
+}
+
+func GetCapacityState(rev string) CapacityState {
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	if c := coldStates[rev]; c != nil {
+		c.settleLocked()
+		return c.state
+	}
+	return CapacitySteady
+}
+
+// revision被删除时调用：还缓冲着的请求全部放出去（由throttler返回错误），不再缓冲新请求
+func forgetColdRevision(rev string) {
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	if c := coldStates[rev]; c != nil {
+		c.state = CapacitySteady
+		pruneColdLocked(rev, c)
+		kickColdReleaser()
+	}
+}
+
+// 需要缓冲的话把u放进它所在revision的缓冲区并返回true
+func holdForCapacity(u SchedulingUnit) bool {
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	c := coldStates[u.Revision]
+	if c == nil {
+		return false
+	}
+	c.settleLocked()
+	if c.state == CapacitySteady && c.buffer.Len() == 0 {
+		return false
+	}
+	releaserOnce.Do(func() { go releaseColdBuffer() })
+	item := &coldItem{}
+	entry := enqueueEntry(&u, &coldMutex)
+	item.u = u
+	heap.Push(&c.buffer, item)
+	entry.remove = func() SchedulingUnit {
+		heap.Remove(&c.buffer, item.index)
+		return item.u
+	}
+	kickColdReleaser()
+	return true
+}
+
+// 放出缓冲的请求，有pod就绪、有新请求进来时被唤醒，另外定时检查（在途任务跑完了也能放出下一个）
+func releaseColdBuffer() {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-coldKick:
+		case <-ticker.C:
+		}
+		for _, u := range takeReleasable() {
+			go func(u SchedulingUnit) {
+				dispatchUnit(u)
+				coldMutex.Lock()
+				if c := coldStates[u.Revision]; c != nil {
+					c.running--
+					pruneColdLocked(u.Revision, c)
+				}
+				coldMutex.Unlock()
+				kickColdReleaser()
+			}(u)
+		}
+	}
+}
+
+func takeReleasable() []SchedulingUnit {
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	var units []SchedulingUnit
+	for rev, c := range coldStates {
+		c.settleLocked()
+		n := len(units)
+		switch c.state {
+		case CapacitySteady:
+			for c.buffer.Len() > 0 {
+				units = append(units, c.popLocked())
+			}
+		case CapacityGrowing:
+			// 刚放出去的请求可能还没到AddReqToRS，所以和自己记的running取大的
+			for free := c.ready*ColdStartPerPod - max(InflightJobNum(rev), c.running); free > 0 && c.buffer.Len() > 0; free-- {
+				units = append(units, c.popLocked())
+			}
+		}
+		c.running += len(units) - n
+		pruneColdLocked(rev, c)
+	}
+	return units
+}
+
+// 取出所有缓冲区中的请求，退出时用
+func takeAllCold() []SchedulingUnit {
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	var units []SchedulingUnit
+	for _, c := range coldStates {
+		for c.buffer.Len() > 0 {
+			units = append(units, c.popLocked())
+		}
+	}
+	return units
+}
+
+// 所有revision缓冲区中的请求数
+func ColdBufferedNum() int {
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	num := 0
+	for _, c := range coldStates {
+		num += c.buffer.Len()
+	}
+	return num
+}
@@ -0,0 +1,205 @@
+// 请求完成的握手：原来HandlerFunc、serveRequest、队列满/拒绝等路径都可能close同一个done通道，
+// 会重复关闭而panic，或者在HandlerFunc返回之后还往ResponseWriter里写。现在改成：
+//   - Completion只能完成一次（sync.Once），第一个完成的一方决定结果，其余的调用什么也不做
+//   - ResponseWriter包一层GuardedWriter交给队列和代理使用，HandlerFunc放弃等待时先Close它，
+//     之后代理再写也只会被丢掉，ResponseWriter回到HandlerFunc手里
+//   - 超时统一由请求上下文的截止时间驱动：排队时由cancel.go把请求从队列删掉，代理时由反向代理自己中断，
+//     HandlerFunc等到同一个截止时间就放弃等待
+
+package shared
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Outcome int
+
+const (
+	OutcomePending   Outcome = iota
+	OutcomeServed            // 已经由代理写好了响应
+	OutcomeQueueFull         // 队列满
+	OutcomeRejected          // 被准入控制、EDF或者退出流程拒绝，已经写了503
+	OutcomeCancelled         // 客户端断开
+	OutcomeTimedOut          // 超过截止时间
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeServed:
+		return "served"
+	case OutcomeQueueFull:
+		return "queue_full"
+	case OutcomeRejected:
+		return "rejected"
+	case OutcomeCancelled:
+		return "cancelled"
+	case OutcomeTimedOut:
+		return "timed_out"
+	default:
+		return "pending"
+	}
+}
+
+// 只能触发一次的信号，用于延迟绑定中的schedulingDone
+type Signal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func NewSignal() *Signal {
+	return &Signal{ch: make(chan struct{})}
+}
+
+func (s *Signal) Fire() {
+	s.once.Do(func() { close(s.ch) })
+}
+
+func (s *Signal) C() <-chan struct{} {
+	return s.ch
+}
+
+// pod选定了，通知等待调度完成的队列取下一个请求
+func MarkScheduled(ctx context.Context) {
+	if s, ok := ctx.Value(SchedulingDoneKey).(*Signal); ok {
+		s.Fire()
+	}
+}
+
+type Completion struct {
+	id      uint64 // 用于WAL中的记录
+	once    sync.Once
+	done    chan struct{}
+	outcome Outcome
+	writer  *GuardedWriter
+}
+
+var completionID atomic.Uint64
+
+func NewCompletion(w http.ResponseWriter) *Completion {
+	return &Completion{
+		id:     completionID.Add(1),
+		done:   make(chan struct{}),
+		writer: &GuardedWriter{w: w, header: make(http.Header)},
+	}
+}
+
+// 交给队列和代理使用的ResponseWriter
+func (c *Completion) Writer() http.ResponseWriter {
+	return c.writer
+}
+
+// 完成请求，只有第一次调用生效并返回true
+func (c *Completion) Finish(o Outcome) bool {
+	won := false
+	c.once.Do(func() {
+		c.outcome = o
+		won = true
+		close(c.done)
+	})
+	if won {
+		walQueueEvent("X", c)
+	}
+	return won
+}
+
+func (c *Completion) Done() <-chan struct{} {
+	return c.done
+}
+
+// Done之后才有意义
+func (c *Completion) Outcome() Outcome {
+	<-c.done
+	return c.outcome
+}
+
+// HandlerFunc不再等待了：还没完成的按超时处理，并收回ResponseWriter。
+// 返回最终结果，以及HandlerFunc之后能不能自己往原来的ResponseWriter写响应（之前什么都还没写）
+func (c *Completion) Abandon() (Outcome, bool) {
+	c.Finish(OutcomeTimedOut)
+	wrote := c.writer.Close()
+	return c.outcome, !wrote
+}
+
+// 请求的统一截止时间：X-Deadline和timeout中更早的那个
+func RequestDeadline(r *http.Request, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if d := parseDeadline(r); !d.IsZero() && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// Close之后所有写操作都被丢弃的ResponseWriter。响应头先写在自己的header里，WriteHeader时才拷贝过去，
+// 这样Close之后代理手里的header也不会和HandlerFunc并发修改同一个map
+type GuardedWriter struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	header http.Header
+	wrote  bool
+	closed bool
+}
+
+func (g *GuardedWriter) Header() http.Header {
+	return g.header
+}
+
+// 调用者需持有g.mu
+func (g *GuardedWriter) writeHeaderLocked(code int) {
+	if g.wrote {
+		return
+	}
+	g.wrote = true
+	dst := g.w.Header()
+	for k, v := range g.header {
+		dst[k] = v
+	}
+	g.w.WriteHeader(code)
+}
+
+func (g *GuardedWriter) WriteHeader(code int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	g.writeHeaderLocked(code)
+}
+
+func (g *GuardedWriter) Write(b []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return 0, http.ErrHandlerTimeout
+	}
+	g.writeHeaderLocked(http.StatusOK)
+	return g.w.Write(b)
+}
+
+func (g *GuardedWriter) Flush() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	if f, ok := g.w.(http.Flusher); ok {
+		g.writeHeaderLocked(http.StatusOK)
+		f.Flush()
+	}
+}
+
+// 给http.ResponseController用
+func (g *GuardedWriter) Unwrap() http.ResponseWriter {
+	return g.w
+}
+
+// 之后的写操作都丢弃，返回之前是否已经写过响应
+func (g *GuardedWriter) Close() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	return g.wrote
+}
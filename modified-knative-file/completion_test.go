@@ -0,0 +1,184 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRequest(ctx context.Context, rate string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	r.Header.Set("X-Rate", rate)
+	return r
+}
+
+// 按HandlerFunc的写法等待：done完成或者截止时间到了，然后Abandon
+func waitLikeHandler(ctx context.Context, done *Completion) (Outcome, bool) {
+	select {
+	case <-done.Done():
+	case <-ctx.Done():
+	}
+	return done.Abandon()
+}
+
+func TestCompletionTimeoutInterleavings(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		handler     func(release <-chan struct{}) http.HandlerFunc
+		queued      bool // 先进队列，等截止时间，不出队
+		wantOutcome Outcome
+		wantBody    string
+		wantServed  bool // handler被调用过
+	}{{
+		name:    "finish before deadline",
+		timeout: time.Minute,
+		handler: func(<-chan struct{}) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+		},
+		wantOutcome: OutcomeServed,
+		wantBody:    "ok",
+		wantServed:  true,
+	}, {
+		name:    "deadline before dispatch",
+		timeout: 20 * time.Millisecond,
+		handler: func(<-chan struct{}) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("late")) }
+		},
+		queued:      true,
+		wantOutcome: OutcomeTimedOut,
+		wantBody:    "timeout",
+	}, {
+		name:    "deadline during proxy",
+		timeout: 20 * time.Millisecond,
+		handler: func(release <-chan struct{}) http.HandlerFunc {
+			// 代理卡住，直到HandlerFunc已经放弃之后才写
+			return func(w http.ResponseWriter, r *http.Request) {
+				<-release
+				w.Write([]byte("late"))
+			}
+		},
+		wantOutcome: OutcomeTimedOut,
+		wantBody:    "timeout",
+		wantServed:  true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			rec := httptest.NewRecorder()
+			done := NewCompletion(rec)
+			release := make(chan struct{})
+			served := make(chan struct{}, 1)
+			inner := tt.handler(release)
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served <- struct{}{}
+				inner(w, r)
+			})
+
+			r := newTestRequest(ctx, "100")
+			u := newSchedulingUnit(h, done.Writer(), r, done)
+			addQueuedWork(u.Revision, u.Work)
+			watchCancel(ctx, done)
+			dispatched := make(chan struct{})
+			if tt.queued {
+				u.Timer = time.NewTimer(time.Hour)
+				QueueMutex.Lock()
+				pushUnit(u)
+				QueueMutex.Unlock()
+				close(dispatched)
+			} else {
+				go func() {
+					defer close(dispatched)
+					dispatchUnit(u)
+				}()
+			}
+
+			outcome, canWrite := waitLikeHandler(ctx, done)
+			if canWrite {
+				rec.Write([]byte("timeout"))
+			}
+			close(release)
+			<-dispatched
+			// 取消监听在自己的goroutine里把请求删出队列，可能比HandlerFunc放弃等待晚一点
+			eventually(t, func() bool { return lookupQueued(done) == nil })
+
+			if outcome != tt.wantOutcome {
+				t.Errorf("outcome = %v, want %v", outcome, tt.wantOutcome)
+			}
+			if got := done.Outcome(); got != outcome {
+				t.Errorf("Outcome() changed to %v after Abandon returned %v", got, outcome)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if got := len(served) > 0; got != tt.wantServed {
+				t.Errorf("handler served = %v, want %v", got, tt.wantServed)
+			}
+			if got := QueuedWork(""); got != 0 {
+				t.Errorf("QueuedWork() = %v, want 0", got)
+			}
+		})
+	}
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+	}
+}
+
+// 截止时间在出队之后、发出之前到了：dispatchUnit不再调用handler
+func TestDispatchAfterDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := NewCompletion(httptest.NewRecorder())
+	h := http.HandlerFunc(func(http.ResponseWriter, *http.Request) { t.Error("handler called after the context ended") })
+	u := newSchedulingUnit(h, done.Writer(), newTestRequest(ctx, "100"), done)
+	addQueuedWork(u.Revision, u.Work)
+
+	dispatchUnit(u)
+	if got := done.Outcome(); got != OutcomeCancelled {
+		t.Errorf("Outcome() = %v, want %v", got, OutcomeCancelled)
+	}
+	if got := QueuedWork(""); got != 0 {
+		t.Errorf("QueuedWork() = %v, want 0", got)
+	}
+}
+
+// Abandon和代理完成同时发生：只有一方的内容能写进ResponseWriter
+func TestAbandonRacingFinish(t *testing.T) {
+	for i := 0; i < 500; i++ {
+		rec := httptest.NewRecorder()
+		done := NewCompletion(rec)
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			done.Writer().Write([]byte("ok"))
+			done.Finish(OutcomeServed)
+		}()
+
+		outcome, canWrite := done.Abandon()
+		if canWrite {
+			rec.Write([]byte("timeout"))
+		}
+		<-finished
+
+		switch body := rec.Body.String(); {
+		case outcome == OutcomeServed && body != "ok":
+			t.Fatalf("served, but body = %q", body)
+		case outcome == OutcomeTimedOut && body != "ok" && body != "timeout":
+			t.Fatalf("timed out, but body = %q", body)
+		case outcome != OutcomeServed && outcome != OutcomeTimedOut:
+			t.Fatalf("outcome = %v", outcome)
+		}
+		if done.Outcome() != outcome {
+			t.Fatalf("Outcome() = %v, Abandon returned %v", done.Outcome(), outcome)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// activator收到SIGTERM后的优雅退出：先停止接收新请求，再把自定义队列里的请求清空
+// （来得及在退出前跑完的直接发给pod，来不及的返回503和Retry-After，让客户端重试到别的activator），
+// 最后等requestStatic里记录的在途任务跑完，并报告丢掉了多少
+
+package shared
+
+import (
+	"container/heap"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	drainingMutex sync.RWMutex
+	draining      = false
+)
+
+type DrainReport struct {
+	Dispatched   int // 清空队列时发给pod的请求数
+	Rejected     int // 清空队列时返回503的请求数
+	InflightLeft int // 等待超时后仍未完成的在途任务数
+}
+
+func (r DrainReport) String() string {
+	return fmt.Sprintf("dispatched=%d rejected=%d inflightLeft=%d", r.Dispatched, r.Rejected, r.InflightLeft)
+}
+
+// 停止接收新请求，之后EnqueueReq一律返回503
+func StopAccepting() {
+	drainingMutex.Lock()
+	defer drainingMutex.Unlock()
+	draining = true
+}
+
+func IsDraining() bool {
+	drainingMutex.RLock()
+	defer drainingMutex.RUnlock()
+	return draining
+}
+
+func rejectDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "activator is draining", http.StatusServiceUnavailable)
+}
+
+// 把所有队列模式下还在排队的请求都取出来
+func takeAllQueued() []SchedulingUnit {
+	var units []SchedulingUnit
+
+	// 逐个删除并标记，ManageQueue可能还拿着其中某个元素，不能直接Init()
+	QueueMutex.Lock()
+	for e := Queue.Front(); e != nil; e = Queue.Front() {
+		u := e.Value.(SchedulingUnit)
+		Queue.Remove(e)
+		if u.take() {
+			units = append(units, u)
+		}
+	}
+	QueueMutex.Unlock()
+
+	EDFQueueMutex.Lock()
+	for EDFQueue.Len() > 0 {
+		u := heap.Pop(&EDFQueue).(*edfItem).u
+		if u.take() {
+			units = append(units, u)
+		}
+	}
+	EDFQueueMutex.Unlock()
+
+	FairQueueMutex.Lock()
+	for _, t := range fairTenants {
+		for e := t.queue.Front(); e != nil; e = t.queue.Front() {
+			u := e.Value.(SchedulingUnit)
+			removeFairLocked(t, e)
+			if u.take() {
+				units = append(units, u)
+			}
+		}
+	}
+	FairQueueMutex.Unlock()
+
+	MLFQQueueMutex.Lock()
+	for level := range mlfqQueues {
+		for e := mlfqQueues[level].Front(); e != nil; e = mlfqQueues[level].Front() {
+			units = append(units, takeMLFQLocked(level, e))
+			mlfqQueuedNum--
+		}
+	}
+	MLFQQueueMutex.Unlock()
+
+	return append(units, takeAllCold()...)
+}
+
+// 清空队列并等待在途任务完成，最多等timeout。调用前应先StopAccepting
+func Drain(timeout time.Duration) DrainReport {
+	var report DrainReport
+	deadline := time.Now().Add(timeout)
+
+	for _, u := range takeAllQueued() {
+		remaining := float64(time.Until(deadline)) / float64(time.Millisecond)
+		if u.Work <= remaining {
+			report.Dispatched++
+			go dispatchUnit(u)
+			continue
+		}
+		report.Rejected++
+		stopWatchCancel(u.Done)
+		addQueuedWork(u.Revision, -u.Work)
+		rejectDraining(u.Writer)
+		u.Done.Finish(OutcomeRejected)
+	}
+
+	for time.Now().Before(deadline) {
+		if InflightJobNum("") == 0 && QueuedWork("") <= 0 {
+			return report
+		}
+		time.Sleep(time.Second)
+	}
+	report.InflightLeft = InflightJobNum("")
+	return report
+}
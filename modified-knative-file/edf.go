@@ -0,0 +1,174 @@
+// 最早截止时间优先（EDF）的队列模式：请求通过X-Deadline（绝对时间戳，毫秒）、X-SLO（相对到达时间的毫秒数）
+// 或revision上的注解带上截止时间，入队前先预测完成时间，赶不上截止时间的直接返回503，
+// 而不是等到在pod上跑了半天再超时
+
+package shared
+
+import (
+	"container/heap"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// revision上用于指定SLO（毫秒）的注解
+const SLOAnnotationKey = "slb.knative.dev/slo"
+
+// 没有截止时间的请求排在所有有截止时间的请求之后，彼此之间按到达顺序
+var noDeadline = time.Unix(1<<40, 0)
+
+// 如果请求头里没有X-Deadline，就根据X-SLO或者revision注解里的SLO算出来写进去
+func SetDeadline(r *http.Request, revSLO string) {
+	if r.Header.Get("X-Deadline") != "" {
+		return
+	}
+	slo := r.Header.Get("X-SLO")
+	if slo == "" {
+		slo = revSLO
+	}
+	sloMillis, err := strconv.ParseFloat(slo, 64)
+	if err != nil || sloMillis <= 0 {
+		return
+	}
+	arrive, err := strconv.ParseFloat(r.Header.Get("X-Arrive-Timestamp"), 64)
+	if err != nil {
+		arrive = nowMillis()
+	}
+	r.Header.Set("X-Deadline", strconv.FormatFloat(arrive+sloMillis, 'f', -1, 64))
+}
+
+type edfItem struct {
+	u        SchedulingUnit
+	deadline time.Time
+	seq      int // 入队序号，截止时间相同时先到先服务
+	work     float64
+	index    int // 在堆里的下标，取消时用heap.Remove
+}
+
+type edfHeap []*edfItem
+
+func (q edfHeap) Len() int { return len(q) }
+func (q edfHeap) Less(i, j int) bool {
+	if q[i].deadline.Equal(q[j].deadline) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].deadline.Before(q[j].deadline)
+}
+func (q edfHeap) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *edfHeap) Push(x interface{}) {
+	item := x.(*edfItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *edfHeap) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*q = old[:n-1]
+	return item
+}
+
+var (
+	EDFQueue      edfHeap
+	EDFQueueMutex sync.Mutex
+	EDFQueueCond  = sync.NewCond(&EDFQueueMutex)
+	edfSeq        = 0
+
+	EDFRejectedNum = 0 // 因预测赶不上截止时间而被拒绝的请求数
+)
+
+// 预测u在EDF队列中的完成时间：同一个revision里排在它前面（截止时间更早）的排队任务和在途任务平摊到它的pod上，
+// 再加上自身的执行时间。调用者需持有EDFQueueMutex
+func predictEDFCompletion(rev string, deadline time.Time, work float64) time.Time {
+	ahead := InflightWork(rev)
+	for _, item := range EDFQueue {
+		if item.u.Revision == rev && !item.deadline.After(deadline) {
+			ahead += item.work
+		}
+	}
+	pods := max(GetPodNum(rev), 1)
+	wait := ahead / float64(pods)
+	return time.Now().Add(time.Duration(wait+work) * time.Millisecond)
+}
+
+func countEDFRejected() {
+	GlobalVarMutex.Lock()
+	defer GlobalVarMutex.Unlock()
+	EDFRejectedNum++
+}
+
+// 拒绝一个请求：写503后完成，让HandlerFunc返回
+func rejectUnit(u SchedulingUnit, reason string) {
+	stopWatchCancel(u.Done)
+	addQueuedWork(u.Revision, -u.Work)
+	http.Error(u.Writer, reason, http.StatusServiceUnavailable)
+	u.Done.Finish(OutcomeRejected)
+}
+
+func AddReqEDF(h http.Handler, w http.ResponseWriter, r *http.Request, done *Completion) {
+	rate, _ := strconv.Atoi(r.Header.Get("X-Rate"))
+	u := newSchedulingUnit(h, w, withSchedulingDone(r), done)
+	item := &edfItem{u: u, deadline: u.Deadline, work: ExpectedExecTime(rate)}
+	if u.Deadline.IsZero() {
+		item.deadline = noDeadline
+	}
+
+	EDFQueueMutex.Lock()
+	defer EDFQueueMutex.Unlock()
+
+	if EDFQueue.Len() >= MaxQueueize {
+		queueFull(u)
+		return
+	}
+
+	// 准入检查：预测完成时间晚于截止时间的，直接拒绝
+	if !u.Deadline.IsZero() && predictEDFCompletion(u.Revision, item.deadline, item.work).After(u.Deadline) {
+		countEDFRejected()
+		rejectUnit(u, "predicted to miss deadline")
+		return
+	}
+
+	if EDFQueue.Len() > MaxQueueActualLen {
+		MaxQueueActualLen = EDFQueue.Len()
+	}
+	edfSeq++
+	item.seq = edfSeq
+	entry := enqueueEntry(&item.u, &EDFQueueMutex)
+	heap.Push(&EDFQueue, item)
+	entry.remove = func() SchedulingUnit {
+		heap.Remove(&EDFQueue, item.index)
+		return item.u
+	}
+	EDFQueueCond.Signal()
+}
+
+// 每次取截止时间最早的请求serve，等它被调度到pod上再取下一个，这样排序才有意义；出队时已经过了截止时间的不再发给pod
+func ManageQueueEDF() {
+	for {
+		EDFQueueMutex.Lock()
+		for EDFQueue.Len() == 0 {
+			EDFQueueCond.Wait()
+		}
+		item := heap.Pop(&EDFQueue).(*edfItem)
+		item.u.take()
+		expired := !item.u.Deadline.IsZero() && time.Now().After(item.u.Deadline)
+		if expired {
+			countEDFRejected()
+		}
+		EDFQueueMutex.Unlock()
+
+		if expired {
+			rejectUnit(item.u, "deadline exceeded while queued")
+			continue
+		}
+		go serveRequest(item.u)
+		waitScheduled(item.u)
+	}
+}
@@ -0,0 +1,166 @@
+// 租户间的加权公平队列（DRR，Deficit Round Robin）：按namespace、revision或者X-Tenant请求头把请求分到不同的子队列，
+// 每轮给每个子队列的额度与其权重成正比，额度用预计执行时间（毫秒）而不是请求个数来计量，
+// 这样一个发大量长任务的客户端没法占满所有pod
+
+package shared
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 请求上下文中存放公平队列分组键的键，由handler放进去
+const TenantKey ContextKey = "tenant"
+
+// 按什么分组："tenant"（X-Tenant请求头）、"namespace"或"revision"，由main.go根据环境变量FAIR_QUEUE_BY设置
+var FairQueueBy = "tenant"
+
+// 每个分组的权重，没配置的按1算，由main.go根据环境变量FAIR_QUEUE_WEIGHTS设置
+var FairQueueWeights = map[string]float64{}
+
+// 权重为1的分组每轮得到的额度（毫秒），取一个中等长度任务的执行时间
+var FairQueueQuantum = 1000.0
+
+// 解析"a=2,b=0.5"这样的权重配置，格式不对的项直接跳过
+func ParseFairQueueWeights(s string) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			continue
+		}
+		weight, err := strconv.ParseFloat(v, 64)
+		if err != nil || weight <= 0 {
+			continue
+		}
+		weights[k] = weight
+	}
+	return weights
+}
+
+// 根据FairQueueBy算出请求的分组键
+func FairKey(r *http.Request, namespace string, revision string) string {
+	switch FairQueueBy {
+	case "namespace":
+		return namespace
+	case "revision":
+		return namespace + "/" + revision
+	default:
+		if tenant := r.Header.Get("X-Tenant"); tenant != "" {
+			return tenant
+		}
+		return namespace
+	}
+}
+
+type fairTenant struct {
+	key     string
+	queue   list.List
+	deficit float64
+	visited bool // 本轮是否已经加过额度
+	elem    *list.Element
+}
+
+func (t *fairTenant) quantum() float64 {
+	weight, ok := FairQueueWeights[t.key]
+	if !ok {
+		weight = 1
+	}
+	return FairQueueQuantum * weight
+}
+
+var (
+	fairTenants    = make(map[string]*fairTenant)
+	fairActive     list.List // 有请求在排队的分组，按轮转顺序
+	fairQueuedNum  = 0
+	FairQueueMutex sync.Mutex
+	FairQueueCond  = sync.NewCond(&FairQueueMutex)
+)
+
+func AddReqFair(h http.Handler, w http.ResponseWriter, r *http.Request, done *Completion) {
+	u := newSchedulingUnit(h, w, withSchedulingDone(r), done)
+	key, _ := r.Context().Value(TenantKey).(string)
+
+	FairQueueMutex.Lock()
+	defer FairQueueMutex.Unlock()
+
+	if fairQueuedNum >= MaxQueueize {
+		queueFull(u)
+		return
+	}
+	if fairQueuedNum > MaxQueueActualLen {
+		MaxQueueActualLen = fairQueuedNum
+	}
+
+	t, ok := fairTenants[key]
+	if !ok {
+		t = &fairTenant{key: key}
+		fairTenants[key] = t
+	}
+	entry := enqueueEntry(&u, &FairQueueMutex)
+	e := t.queue.PushBack(u)
+	entry.remove = func() SchedulingUnit {
+		removeFairLocked(t, e)
+		return u
+	}
+	fairQueuedNum++
+	if t.elem == nil {
+		t.elem = fairActive.PushBack(t)
+	}
+	FairQueueCond.Signal()
+}
+
+// 从分组的队列里删掉e，调用者需持有FairQueueMutex。没有请求了就退出轮转，额度清零，免得空闲的分组攒额度
+func removeFairLocked(t *fairTenant, e *list.Element) {
+	t.queue.Remove(e)
+	fairQueuedNum--
+	if t.queue.Len() == 0 {
+		fairActive.Remove(t.elem)
+		t.elem = nil
+		t.deficit = 0
+		t.visited = false
+		delete(fairTenants, t.key)
+	}
+}
+
+// DRR：轮到的分组先加一次额度，额度够就取队头的请求，不够就排到队尾等下一轮。
+// 调用者需持有FairQueueMutex且fairActive非空；每轮每个分组的额度都会增加，所以循环总会取到请求
+func popFair() SchedulingUnit {
+	for {
+		t := fairActive.Front().Value.(*fairTenant)
+		if !t.visited {
+			t.deficit += t.quantum()
+			t.visited = true
+		}
+		e := t.queue.Front()
+		u := e.Value.(SchedulingUnit)
+		work := max(u.Work, 1)
+		if work > t.deficit {
+			t.visited = false
+			fairActive.MoveToBack(t.elem)
+			continue
+		}
+		t.deficit -= work
+		u.take()
+		removeFairLocked(t, e)
+		return u
+	}
+}
+
+// 和EDF一样等请求被调度到pod上再发下一个，否则所有请求都会立刻发出去，分组也就没有意义了
+func ManageQueueFair() {
+	for {
+		FairQueueMutex.Lock()
+		for fairActive.Len() == 0 {
+			FairQueueCond.Wait()
+		}
+		u := popFair()
+		FairQueueMutex.Unlock()
+
+		go serveRequest(u)
+		waitScheduled(u)
+	}
+}
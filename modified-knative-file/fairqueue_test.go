@@ -0,0 +1,71 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 把一个属于tenant的请求放进公平队列，和handler一样在上下文里放分组键
+func addFairTestReq(t *testing.T, tenant string, rate string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Rate", rate)
+	r = r.WithContext(context.WithValue(r.Context(), TenantKey, tenant))
+	done := NewCompletion(httptest.NewRecorder())
+	AddReqFair(http.NotFoundHandler(), done.Writer(), r, done)
+}
+
+// 两个分组一直有请求排队时，按权重1:2分到执行时间
+func TestFairQueueWeights(t *testing.T) {
+	oldQuantum, oldWeights := FairQueueQuantum, FairQueueWeights
+	t.Cleanup(func() {
+		FairQueueQuantum, FairQueueWeights = oldQuantum, oldWeights
+		ResetState()
+	})
+	// 额度正好是一个请求的执行时间，a每轮发1个，b每轮发2个
+	FairQueueQuantum = ExpectedExecTime(100)
+	FairQueueWeights = map[string]float64{"a": 1, "b": 2}
+	for i := 0; i < 30; i++ {
+		addFairTestReq(t, "a", "100")
+		addFairTestReq(t, "b", "100")
+	}
+
+	work := map[string]float64{}
+	FairQueueMutex.Lock()
+	for i := 0; i < 30; i++ {
+		u := popFair()
+		work[u.Req.Context().Value(TenantKey).(string)] += u.Work
+	}
+	FairQueueMutex.Unlock()
+	if work["b"] != 2*work["a"] {
+		t.Errorf("dispatched work a=%v b=%v, want 1:2", work["a"], work["b"])
+	}
+}
+
+// 分组的队列空了就退出轮转，剩下的额度清零，再来请求时从零开始攒
+func TestFairQueueDeficitResetsWhenEmpty(t *testing.T) {
+	oldQuantum := FairQueueQuantum
+	t.Cleanup(func() {
+		FairQueueQuantum = oldQuantum
+		ResetState()
+	})
+	FairQueueQuantum = 1.5 * ExpectedExecTime(100)
+	addFairTestReq(t, "a", "100")
+
+	FairQueueMutex.Lock()
+	popFair()
+	_, active := fairTenants["a"]
+	FairQueueMutex.Unlock()
+	if active {
+		t.Fatal("empty tenant is still in the rotation")
+	}
+
+	addFairTestReq(t, "a", "100")
+	FairQueueMutex.Lock()
+	defer FairQueueMutex.Unlock()
+	if d := fairTenants["a"].deficit; d != 0 {
+		t.Errorf("deficit after the queue emptied = %v, want 0", d)
+	}
+}
@@ -0,0 +1,259 @@
+// 本地替身pod：不需要kind、Knative、Istio和alu-bench镜像，用Go模拟alu.py和real-world的行为，
+// 方便在go test里用httptest把handler、队列和lbPolicy整条链跑起来。
+//   - 读X-Rate、X-Request-Timestamp、X-Arrive-Timestamp（real-world还要X-Seq-Start-Time）、X-Last-Rate，缺了就返回"lack headers"
+//   - 按rate对应的时间睡眠或者空转：ALU用shared.JoblenMapALU，real-world的rate本身就是毫秒数
+//   - 返回和Python服务一样的五个字段，再把同样的内容POST到StoreURL，带上X-PodIP和X-Dispatch-ID
+//   - 和Python服务一样支持POST /preempt?id=和/resume?id=，开始执行时POST StartURL?id=<X-Dispatch-ID>确认
+//   - QueueProxy模拟pod前面的queue-proxy，按containerConcurrency限制同时执行的请求数
+//
+// 用法：
+//	pod := fakepod.New(fakepod.Config{Mode: fakepod.ModeALU, PodIP: "10.0.0.1", StoreURL: store.URL + "/store"})
+//	srv := httptest.NewServer(pod)
+
+package fakepod
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"knative.dev/serving/pkg/shared"
+)
+
+type Mode int
+
+const (
+	ModeALU       Mode = iota // slb-simplified/alu/alu.py
+	ModeRealWorld             // slb-simplified/real-world/__main__.py
+)
+
+type Config struct {
+	Mode     Mode
+	PodIP    string        // 回调时放在X-PodIP里
+	StoreURL string        // activator的/store地址，为空时不回调
+	StartURL string        // activator的/start地址，为空时不确认
+	Scale    float64       // 执行时间乘以这个系数，0按1算；测试里一般调小
+	Spin     bool          // 空转占CPU而不是睡眠，用来模拟单核pod上的争抢
+	MaxPause time.Duration // 被暂停超过这么久自己继续，0按10秒算
+	Client   *http.Client  // 回调用的client，为空时用http.DefaultClient
+}
+
+type Server struct {
+	cfg Config
+	mux *http.ServeMux
+
+	mu     sync.Mutex
+	jobs   map[string]*job
+	served int
+}
+
+// 暂停的任务等resume关闭的通道
+type job struct {
+	mu     sync.Mutex
+	resume chan struct{} // nil表示正在运行
+}
+
+func New(cfg Config) *Server {
+	if cfg.Scale == 0 {
+		cfg.Scale = 1
+	}
+	if cfg.MaxPause == 0 {
+		cfg.MaxPause = 10 * time.Second
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	s := &Server{cfg: cfg, mux: http.NewServeMux(), jobs: make(map[string]*job)}
+	s.mux.HandleFunc("/preempt", s.control(true))
+	s.mux.HandleFunc("/resume", s.control(false))
+	s.mux.HandleFunc("/", s.handle)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// QueueProxy 模拟queue-proxy：最多同时把concurrency个请求交给pod，多出来的排队等着。
+// Server本身相当于用户容器的端口，控制请求和绕过queue-proxy的请求直接发给它
+func (s *Server) QueueProxy(concurrency int) http.Handler {
+	sem := make(chan struct{}, concurrency)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+		defer func() { <-sem }()
+		s.ServeHTTP(w, r)
+	})
+}
+
+// 已经执行完的请求数
+func (s *Server) Served() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.served
+}
+
+func nowMillis() float64 {
+	return float64(time.Now().UnixNano()) / float64(time.Millisecond)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	routeTime, err1 := strconv.ParseFloat(r.Header.Get("X-Request-Timestamp"), 64)
+	arriveTime, err2 := strconv.ParseFloat(r.Header.Get("X-Arrive-Timestamp"), 64)
+	rate, err3 := strconv.Atoi(r.Header.Get("X-Rate"))
+	seqStartStr := r.Header.Get("X-Seq-Start-Time")
+	if err1 != nil || err2 != nil || err3 != nil || (s.cfg.Mode == ModeRealWorld && seqStartStr == "") {
+		fmt.Fprint(w, "lack headers")
+		return
+	}
+	lastRate := r.Header.Get("X-Last-Rate")
+	if lastRate == "" {
+		lastRate = "0"
+	}
+
+	var execMillis float64
+	if s.cfg.Mode == ModeALU {
+		execMillis = float64(shared.JoblenMapALU[rate])
+	} else {
+		execMillis = float64(rate)
+	}
+
+	dispatchID := r.Header.Get("X-Dispatch-ID")
+	j := &job{}
+	if dispatchID != "" {
+		s.mu.Lock()
+		s.jobs[dispatchID] = j
+		s.mu.Unlock()
+	}
+	startTime := nowMillis()
+	if dispatchID != "" {
+		go s.ack(dispatchID)
+	}
+	s.run(r.Context(), j, time.Duration(execMillis*s.cfg.Scale*float64(time.Millisecond)))
+	endTime := nowMillis()
+	s.mu.Lock()
+	delete(s.jobs, dispatchID)
+	s.served++
+	s.mu.Unlock()
+
+	responseTime := startTime - arriveTime
+	latency := endTime - arriveTime
+	var ret string
+	if s.cfg.Mode == ModeALU {
+		jct := endTime - routeTime
+		ret = fmt.Sprintf("%d %v %v %v %s\n", rate, responseTime, jct, latency, lastRate)
+	} else {
+		seqLat := 0.0
+		if seqStart, _ := strconv.ParseFloat(seqStartStr, 64); seqStart != 0 {
+			seqLat = endTime - seqStart
+		}
+		ret = fmt.Sprintf("%v %v %d %v %s\n", seqLat, responseTime, rate, latency, lastRate)
+	}
+
+	if err := s.store(ret, dispatchID); err != nil {
+		fmt.Fprintf(w, "%s 无法将任务信息发给activator %s：%v", ret, s.cfg.StoreURL, err)
+		return
+	}
+	fmt.Fprint(w, ret)
+}
+
+// 执行d这么久，期间被暂停的时间不算。客户端断开了就不再执行（Python服务做不到，这里顺便省点测试时间）
+func (s *Server) run(ctx context.Context, j *job, d time.Duration) {
+	const slice = 5 * time.Millisecond
+	for d > 0 {
+		j.mu.Lock()
+		resume := j.resume
+		j.mu.Unlock()
+		if resume != nil {
+			select {
+			case <-resume:
+			case <-time.After(s.cfg.MaxPause):
+				j.setPaused(false)
+			case <-ctx.Done():
+				return
+			}
+		}
+		step := min(d, slice)
+		if s.cfg.Spin {
+			for end := time.Now().Add(step); time.Now().Before(end); {
+			}
+		} else {
+			select {
+			case <-time.After(step):
+			case <-ctx.Done():
+				return
+			}
+		}
+		d -= step
+	}
+}
+
+func (j *job) setPaused(paused bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if paused && j.resume == nil {
+		j.resume = make(chan struct{})
+	} else if !paused && j.resume != nil {
+		close(j.resume)
+		j.resume = nil
+	}
+}
+
+func (s *Server) control(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.mu.Lock()
+		j, ok := s.jobs[r.URL.Query().Get("id")]
+		s.mu.Unlock()
+		if !ok {
+			http.Error(w, "no such job", http.StatusNotFound)
+			return
+		}
+		j.setPaused(pause)
+		fmt.Fprint(w, "ok")
+	}
+}
+
+// 告诉activator任务开始执行了，失败了只是这个任务不会被暂停
+func (s *Server) ack(dispatchID string) {
+	if s.cfg.StartURL == "" {
+		return
+	}
+	resp, err := s.cfg.Client.Post(s.cfg.StartURL+"?id="+url.QueryEscape(dispatchID), "text/plain", nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+func (s *Server) store(body string, dispatchID string) error {
+	if s.cfg.StoreURL == "" {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, s.cfg.StoreURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-PodIP", s.cfg.PodIP)
+	req.Header.Set("X-Dispatch-ID", dispatchID)
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
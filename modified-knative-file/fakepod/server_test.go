@@ -0,0 +1,292 @@
+package fakepod
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"knative.dev/serving/pkg/shared"
+)
+
+// 记下/store和/start回调
+type activator struct {
+	mu      sync.Mutex
+	stored  []string
+	podIPs  []string
+	ids     []string
+	started []string
+}
+
+func (a *activator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch r.URL.Path {
+	case "/store":
+		body, _ := io.ReadAll(r.Body)
+		a.stored = append(a.stored, string(body))
+		a.podIPs = append(a.podIPs, r.Header.Get("X-PodIP"))
+		a.ids = append(a.ids, r.Header.Get("X-Dispatch-ID"))
+	case "/start":
+		a.started = append(a.started, r.URL.Query().Get("id"))
+	}
+}
+
+func millis(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Millisecond), 'f', -1, 64)
+}
+
+func newJob(t *testing.T, url string, rate string, id string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	req.Header.Set("X-Rate", rate)
+	req.Header.Set("X-Request-Timestamp", millis(now))
+	req.Header.Set("X-Arrive-Timestamp", millis(now.Add(-10*time.Millisecond)))
+	req.Header.Set("X-Seq-Start-Time", millis(now.Add(-20*time.Millisecond)))
+	req.Header.Set("X-Dispatch-ID", id)
+	return req
+}
+
+func get(t *testing.T, req *http.Request) []string {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return strings.Fields(string(body))
+}
+
+func TestResponseAndStoreFields(t *testing.T) {
+	tests := []struct {
+		name string
+		mode Mode
+		rate string
+		// 返回内容里rate所在的位置，/store里的rate也在这里
+		rateField int
+	}{
+		// ALU：rate resp jct lat last
+		{"alu", ModeALU, "5", 0},
+		// real-world：seqlat resp rate lat last
+		{"real-world", ModeRealWorld, "20", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			act := &activator{}
+			store := httptest.NewServer(act)
+			defer store.Close()
+			pod := httptest.NewServer(New(Config{Mode: tt.mode, PodIP: "10.0.0.1", StoreURL: store.URL + "/store", Scale: 0.01}))
+			defer pod.Close()
+
+			fields := get(t, newJob(t, pod.URL, tt.rate, "job-1"))
+			if len(fields) != 5 {
+				t.Fatalf("response %v has %d fields, want 5", fields, len(fields))
+			}
+			if fields[tt.rateField] != tt.rate {
+				t.Errorf("response field %d = %q, want rate %q", tt.rateField, fields[tt.rateField], tt.rate)
+			}
+			if fields[4] != "0" {
+				t.Errorf("last rate = %q, want 0", fields[4])
+			}
+			// 响应时间（第2项）不超过总延迟（第4项）
+			resp, _ := strconv.ParseFloat(fields[1], 64)
+			lat, _ := strconv.ParseFloat(fields[3], 64)
+			if resp < 0 || lat < resp {
+				t.Errorf("response time %v, latency %v", resp, lat)
+			}
+
+			act.mu.Lock()
+			defer act.mu.Unlock()
+			if len(act.stored) != 1 {
+				t.Fatalf("got %d /store callbacks, want 1", len(act.stored))
+			}
+			// /store里是同样的内容，带上pod的ip和X-Dispatch-ID
+			if got := strings.Fields(act.stored[0]); strings.Join(got, " ") != strings.Join(fields, " ") {
+				t.Errorf("/store body %v, want %v", got, fields)
+			}
+			if act.podIPs[0] != "10.0.0.1" || act.ids[0] != "job-1" {
+				t.Errorf("/store headers X-PodIP=%q X-Dispatch-ID=%q", act.podIPs[0], act.ids[0])
+			}
+		})
+	}
+}
+
+func TestLackHeaders(t *testing.T) {
+	pod := httptest.NewServer(New(Config{Mode: ModeRealWorld}))
+	defer pod.Close()
+	req := newJob(t, pod.URL, "20", "job-1")
+	req.Header.Del("X-Seq-Start-Time")
+	if got := strings.Join(get(t, req), " "); got != "lack headers" {
+		t.Errorf("response = %q, want lack headers", got)
+	}
+}
+
+func TestPreemptResume(t *testing.T) {
+	act := &activator{}
+	store := httptest.NewServer(act)
+	defer store.Close()
+	srv := New(Config{Mode: ModeRealWorld, StoreURL: store.URL + "/store", StartURL: store.URL + "/start"})
+	pod := httptest.NewServer(srv)
+	defer pod.Close()
+
+	post := func(path string) int {
+		resp, err := http.Post(pod.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("/preempt?id=missing"); code != http.StatusNotFound {
+		t.Errorf("preempt of unknown job = %d, want 404", code)
+	}
+
+	// 100毫秒的任务，暂停200毫秒之后恢复，总共至少300毫秒
+	start := time.Now()
+	req := newJob(t, pod.URL, "100", "job-1")
+	done := make(chan error)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	// 开始执行时会回调/start
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		act.mu.Lock()
+		started := len(act.started) == 1 && act.started[0] == "job-1"
+		act.mu.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no /start callback within 1s")
+		}
+	}
+	if code := post("/preempt?id=job-1"); code != http.StatusOK {
+		t.Fatalf("preempt = %d, want 200", code)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if srv.Served() != 0 {
+		t.Fatal("paused job finished")
+	}
+	if code := post("/resume?id=job-1"); code != http.StatusOK {
+		t.Fatalf("resume = %d, want 200", code)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("job took %v, want at least 300ms with a 200ms pause", elapsed)
+	}
+	if code := post("/resume?id=job-1"); code != http.StatusNotFound {
+		t.Errorf("resume of finished job = %d, want 404", code)
+	}
+}
+
+// containerConcurrency为1时，经过queue-proxy的短任务排在被暂停的长任务后面；
+// 暂停了长任务的短任务直接发到用户容器的端口，长任务暂停期间就能跑完
+func TestShortJobBypassesQueueProxyWhilePreempting(t *testing.T) {
+	act := &activator{}
+	callbacks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			shared.AckRunning(r.URL.Query().Get("id"))
+		}
+		act.ServeHTTP(w, r)
+	}))
+	defer callbacks.Close()
+	srv := New(Config{Mode: ModeRealWorld, StoreURL: callbacks.URL + "/store", StartURL: callbacks.URL + "/start"})
+	user := httptest.NewServer(srv)
+	defer user.Close()
+	qp := httptest.NewServer(srv.QueueProxy(1))
+	defer qp.Close()
+
+	host, port, _ := net.SplitHostPort(user.Listener.Addr().String())
+	oldPort, oldRunning := shared.PodControlPort, shared.PreemptRunning
+	shared.PodControlPort, _ = strconv.Atoi(port)
+	shared.PreemptRunning = true
+	t.Cleanup(func() { shared.PodControlPort, shared.PreemptRunning = oldPort, oldRunning })
+	shared.GlobalVarMutex.Lock()
+	preempted := shared.PreemptedJobNum
+	shared.GlobalVarMutex.Unlock()
+
+	// 5秒的长任务经过queue-proxy，占着唯一的名额
+	qpDest := qp.Listener.Addr().String()
+	defer shared.TrackRunning(host, qpDest, "long-1", 5000)()
+	ctx, cancel := context.WithCancel(context.Background())
+	longDone := make(chan struct{})
+	go func() {
+		defer close(longDone)
+		if resp, err := http.DefaultClient.Do(newJob(t, qp.URL, "5000", "long-1").WithContext(ctx)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	defer func() {
+		cancel()
+		<-longDone
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		act.mu.Lock()
+		started := len(act.started) == 1
+		act.mu.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no /start callback within 1s")
+		}
+	}
+
+	resume, direct := shared.PreemptFor(context.Background(), host, 5)
+	defer resume()
+	if !direct {
+		t.Fatal("short job not sent around queue-proxy while the long job is paused")
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		shared.GlobalVarMutex.Lock()
+		paused := shared.PreemptedJobNum == preempted+1
+		shared.GlobalVarMutex.Unlock()
+		if paused {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("long job not paused within 1s")
+		}
+	}
+
+	// 经过queue-proxy的话，短任务等不到名额
+	blockedCtx, cancelBlocked := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelBlocked()
+	if resp, err := http.DefaultClient.Do(newJob(t, qp.URL, "5", "short-0").WithContext(blockedCtx)); err == nil {
+		resp.Body.Close()
+		t.Error("short job passed queue-proxy while the paused long job held it")
+	}
+
+	start := time.Now()
+	if fields := get(t, newJob(t, "http://"+shared.UserContainerDest(qpDest), "5", "short-1")); len(fields) != 5 {
+		t.Fatalf("short job response %v, want 5 fields", fields)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("short job took %v", elapsed)
+	}
+	select {
+	case <-longDone:
+		t.Error("long job returned while paused")
+	default:
+	}
+	if srv.Served() != 1 {
+		t.Errorf("served = %d, want only the short job", srv.Served())
+	}
+}
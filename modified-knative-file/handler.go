@@ -22,9 +22,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.opencensus.io/plugin/ochttp"
@@ -51,7 +53,7 @@ import (
 
 // Throttler is the interface that Handler calls to Try to proxy the user request.
 type Throttler interface {
-	Try(ctx context.Context, revID types.NamespacedName, fn func(string) error) error
+	Try(ctx context.Context, revID types.NamespacedName, fn func(context.Context, string) error) error
 }
 
 // activationHandler will wait for an active endpoint for a revision
@@ -82,6 +84,9 @@ func New(_ context.Context, t Throttler, transport http.RoundTripper, usePassthr
 	}
 }
 
+// alu请求从到达activator开始算的总超时时间，有SLO的话取更早的那个
+const requestTimeout = 120 * time.Second
+
 // 定义用于在 context 中存储和检索 lbPolicy和rate 的键
 type lbPolicyKey struct{}
 type rateKey struct{}
@@ -111,26 +116,71 @@ func (a *activationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	rate := r.Header.Get("X-Rate")
 	ctx_with_lbpolicy := context.WithValue(tryContext, rateKey{}, rate)
+	ctx_with_lbpolicy = context.WithValue(ctx_with_lbpolicy, shared.RateKey, rate)
+	// sequence中的action带上sequence ID，lbPolicy据此把后续action放到上一个action所在的pod
+	if seqID := r.Header.Get("X-Seq-ID"); seqID != "" {
+		ctx_with_lbpolicy = context.WithValue(ctx_with_lbpolicy, shared.SeqIDKey, seqID)
+	}
+
+	// 小任务的GET请求可以对冲，throttler会在等太久时再发一份副本
+	hedged := shared.ShouldHedge(shared.RateFromContext(ctx_with_lbpolicy)) && r.Method == http.MethodGet
+	if hedged {
+		ctx_with_lbpolicy = context.WithValue(ctx_with_lbpolicy, shared.HedgeKey, true)
+	}
+	var hedgeWritten atomic.Bool
 
 	// arrive_timestamp := r.Header.Get("X-Arrive-Timestamp")
-	if err := a.throttler.Try(ctx_with_lbpolicy, revID, func(dest string) error {
+	if err := a.throttler.Try(ctx_with_lbpolicy, revID, func(attemptCtx context.Context, dest string) error {
 		trySpan.End()
 
-		proxyCtx, proxySpan := r.Context(), (*trace.Span)(nil)
+		// 对冲时两份请求各自用throttler给的可取消上下文，输的那份会被取消
+		baseCtx := r.Context()
+		if hedged {
+			baseCtx = attemptCtx
+		}
+		proxyCtx, proxySpan := baseCtx, (*trace.Span)(nil)
 		if tracingEnabled {
-			proxyCtx, proxySpan = trace.StartSpan(r.Context(), "activator_proxy")
+			proxyCtx, proxySpan = trace.StartSpan(baseCtx, "activator_proxy")
 		}
 
 		// 修改队列实现方式之后，方便起见将last_rate设为本任务抢占的任务的rate
 
-		// 延迟绑定中，关闭上下文中存放的schedulingDone通道
-		schedulingDone, _ := r.Context().Value(shared.SchedulingDoneKey).(chan struct{})
-		close(schedulingDone)
+		// 延迟绑定中，触发上下文中存放的schedulingDone信号
+		// 只有需要等待调度完成的队列模式会放这个信号
+		shared.MarkScheduled(r.Context())
+
+		// 工作窃取：先在选中pod的等待队列里排队，可能被别的空闲pod偷走，dest换成偷走它的pod
+		if shared.WorkStealing {
+			podip, err := shared.AcquirePodSlot(proxyCtx, revID.String(), strings.Split(dest, ":")[0])
+			if err != nil {
+				// 客户端已经放弃或者超时了，HandlerFunc那边会处理响应
+				proxySpan.End()
+				return nil
+			}
+			dest = podip + dest[strings.Index(dest, ":"):]
+		}
 
-		a.proxyRequest(revID, w, r.WithContext(proxyCtx), dest, tracingEnabled, a.usePassthroughLb)
+		var err error
+		if !hedged {
+			err = a.proxyRequest(revID, w, r.WithContext(proxyCtx), dest, tracingEnabled, a.usePassthroughLb)
+		} else {
+			// 两份并发执行，各自用克隆的请求（proxyRequest会改请求头）和自己的ResponseRecorder，
+			// 没被取消的那份把结果写回w
+			// 失败（包括pod返回的5xx）的那份返回错误，throttler会等另一份，两份都失败才算失败
+			recorder := httptest.NewRecorder()
+			err = a.proxyRequest(revID, recorder, r.Clone(proxyCtx), dest, tracingEnabled, a.usePassthroughLb)
+			switch {
+			case attemptCtx.Err() != nil:
+				err = attemptCtx.Err()
+			case err == nil && recorder.Code >= http.StatusInternalServerError:
+				err = fmt.Errorf("%w: %s: %w %d", shared.ErrPodFailed, dest, errPodStatus, recorder.Code)
+			case err == nil && hedgeWritten.CompareAndSwap(false, true):
+				writeRecorded(w, recorder)
+			}
+		}
 		proxySpan.End()
 
-		return nil
+		return err
 	}); err != nil {
 		// Set error on our capacity waiting span and end it.
 		trySpan.Annotate([]trace.Attribute{trace.StringAttribute("activator.throttler.error", err.Error())}, "ThrottlerTry")
@@ -140,6 +190,9 @@ func (a *activationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, queue.ErrRequestQueueFull) {
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else if errors.Is(err, shared.ErrPodFailed) {
+			// 重试次数用完了
+			http.Error(w, err.Error(), http.StatusBadGateway)
 		} else {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
@@ -147,8 +200,12 @@ func (a *activationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // 执行完了负载均衡算法才会回调这个函数，将请求发给pod
+// ModifyResponse把pod返回的502转成错误交给ErrorHandler时用，状态码已经统计过了
+var errPodStatus = errors.New("pod returned status")
+
+// 可以重试的请求发往pod失败时不写响应，回滚占用后返回shared.ErrPodFailed，由throttler换一个pod重试
 func (a *activationHandler) proxyRequest(revID types.NamespacedName, w http.ResponseWriter,
-	r *http.Request, target string, tracingEnabled bool, usePassthroughLb bool) {
+	r *http.Request, target string, tracingEnabled bool, usePassthroughLb bool) error {
 	netheader.RewriteHostIn(r)
 	r.Header.Set(netheader.ProxyKey, activator.Name)
 
@@ -160,6 +217,26 @@ func (a *activationHandler) proxyRequest(revID types.NamespacedName, w http.Resp
 	rate, _ := strconv.Atoi(r.Header.Get("X-Rate"))
 	targetip := strings.Split(target, ":")[0]
 	shared.AddReqToRS(targetip, rate)
+	if seqID := r.Header.Get("X-Seq-ID"); seqID != "" {
+		shared.RecordSeqPod(seqID, targetip)
+	}
+	// 记下发出时间，pod回调/store时带回X-Dispatch-ID，用来统计该函数的实际运行时间（MLFQ用）
+	dispatchID := shared.MarkDispatched(shared.MLFQKey(r))
+	r.Header.Set("X-Dispatch-ID", dispatchID)
+	// 请求有没有完整写到pod上，取消时据此判断pod会不会回调/store
+	var wrote atomic.Bool
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { wrote.Store(true) },
+	}))
+	// 长任务记下来，pod确认开始执行后，之后的短任务可以暂停它；短任务先暂停pod上正在跑的长任务，返回后再恢复
+	defer shared.TrackRunning(targetip, target, dispatchID, rate)()
+	resume, direct := shared.PreemptFor(r.Context(), targetip, rate)
+	defer resume()
+	// 暂停了长任务的短任务不经过queue-proxy，否则containerConcurrency为1时会排在被暂停的长任务后面
+	proxyTarget := target
+	if direct {
+		proxyTarget = shared.UserContainerDest(target)
+	}
 	// 下面这行是ALU的实验3时，已知rate的情况下用来添加任务执行时间的，至于实验4就得在main函数中获取返回的实际执行时间了
 	// shared.AddJobToGlobalVar(float64(shared.JoblenMap[rate]))
 
@@ -170,10 +247,10 @@ func (a *activationHandler) proxyRequest(revID types.NamespacedName, w http.Resp
 	}
 
 	var proxy *httputil.ReverseProxy
-	if a.tls {
+	if a.tls && !direct {
 		proxy = pkghttp.NewHeaderPruningReverseProxy(useSecurePort(target), hostOverride, activator.RevisionHeaders, true /* uss HTTPS */)
 	} else {
-		proxy = pkghttp.NewHeaderPruningReverseProxy(target, hostOverride, activator.RevisionHeaders, false /* use HTTPS */)
+		proxy = pkghttp.NewHeaderPruningReverseProxy(proxyTarget, hostOverride, activator.RevisionHeaders, false /* use HTTPS */)
 	}
 
 	proxy.BufferPool = a.bufferPool
@@ -182,12 +259,56 @@ func (a *activationHandler) proxyRequest(revID types.NamespacedName, w http.Resp
 		proxy.Transport = a.tracingTransport
 	}
 	proxy.FlushInterval = netproxy.FlushInterval
+	// GET请求可以安全地重发：连接失败或者pod返回502（pod刚被缩掉）时交给throttler重试
+	retryable := shared.MaxPodRetries > 0 && r.Method == http.MethodGet
+	var podErr error
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// 状态码交给异常检测，连续5xx的pod会被暂时踢出
+		shared.ReportPodStatus(targetip, resp.StatusCode)
+		if retryable && resp.StatusCode == http.StatusBadGateway {
+			return fmt.Errorf("%w %d", errPodStatus, resp.StatusCode)
+		}
+		return nil
+	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		// 请求没能拿到pod的回复，不会再有/store回调带回这个ID了
+		shared.ForgetDispatch(dispatchID)
+		// 客户端自己取消的（或者对冲输掉的）不算pod的问题；请求还没写出去的话pod不会回调/store，撤销占用
+		if req.Context().Err() != nil {
+			if !wrote.Load() {
+				shared.UndoDispatch(targetip, rate, dispatchID)
+			}
+			pkghandler.Error(a.logger.With(zap.String(logkey.Key, revID.String())))(w, req, err)
+			return
+		}
+		if !errors.Is(err, errPodStatus) {
+			shared.ReportPodStatus(targetip, http.StatusBadGateway)
+		}
+		if retryable {
+			podErr = err
+			return
+		}
+		// 不重试的话这个请求就失败了，pod不会回调/store，占用和工作窃取的位置都由这里撤销
+		shared.RollbackDispatch(targetip, rate, dispatchID)
 		pkghandler.Error(a.logger.With(zap.String(logkey.Key, revID.String())))(w, req, err)
 	}
 
 	// 将请求发往目标pod
 	proxy.ServeHTTP(w, r)
+
+	if podErr != nil {
+		shared.RollbackDispatch(targetip, rate, dispatchID)
+		return fmt.Errorf("%w: %s: %w", shared.ErrPodFailed, target, podErr)
+	}
+	return nil
+}
+
+func writeRecorded(w http.ResponseWriter, recorder *httptest.ResponseRecorder) {
+	for k, v := range recorder.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(recorder.Code)
+	w.Write(recorder.Body.Bytes())
 }
 
 // useSecurePort replaces the default port with HTTPS port (8112).
@@ -210,60 +331,30 @@ func WrapActivatorHandlerWithFullDuplex(h http.Handler, logger *zap.SugaredLogge
 		// 先查看revision id
 		revID := RevIDFrom(r.Context()) // alu-bench-00001，如果是real-world那就是real-world-00001
 
-		// 如果是real-world，说明收到了一个sequence，需要顺序执行，每个action返回后还要摇一个等待时间。直到发完所有action，再return
-		if strings.Contains(revID.Name, "real-world") {
-			seqlen := shared.GetSeqLen()
-			// fmt.Println("\n###当前请求的sequence长度为", seqlen)
-
-			// 如果是sequence中的最后一个action，则用它作为X-Seq-Start-Time，否则用0
-			seqStartTime := strconv.FormatFloat(float64(time.Now().UnixNano())/float64(time.Millisecond), 'f', -1, 64)
-			seqAvgIAT := shared.GetRandAvgIAT()
-			seqCV := shared.GetRandCV()
-
-			var results []string
-
-			for seq := 0; seq < seqlen; seq++ {
-				tmpRate := shared.GetRandZipf() // shared.GetRandExecTime() / 10
-
-				tmpInterval := shared.GetRandIAT(seqAvgIAT, seqCV)
-				if seq == seqlen-1 {
-					tmpInterval = 0
-				}
-				// fmt.Println("#第", seq, "个任务的rate为", tmpRate, "IAT为", tmpInterval)
-
-				// 为每个任务创建新的请求对象和临时ResponseRecorder（因为ResponseWriter只能用在整个sequence上）
-				newReq := r.Clone(r.Context())
-				recorder := httptest.NewRecorder()
-
-				newReq.Header.Set("X-Rate", strconv.Itoa(tmpRate))
-				newReq.Header.Set("X-Arrive-Timestamp", strconv.FormatFloat(float64(time.Now().UnixNano())/float64(time.Millisecond), 'f', -1, 64))
-				newReq.Header.Set("X-Last-Rate", "")
-				if seq == seqlen-1 {
-					newReq.Header.Set("X-Seq-Start-Time", seqStartTime)
-				} else {
-					newReq.Header.Set("X-Seq-Start-Time", "0")
-				}
-
-				done := make(chan struct{})
-				shared.AddReq(h, recorder, newReq, done)
-
-				select {
-				case <-done:
-					// 获取子任务的返回内容
-					result := recorder.Body.String()
-					results = append(results, result)
-				case <-time.After(320 * time.Second):
-					fmt.Println("###sequence的第", seq, "个任务整体超时，不管了直接关done通道")
-					close(done)
-				}
-
-				time.Sleep(time.Duration(tmpInterval) * time.Millisecond)
-			}
+		// 有SLO的话，截止时间从到达activator开始算
+		r.Header.Set("X-Arrive-Timestamp", strconv.FormatFloat(float64(time.Now().UnixNano())/float64(time.Millisecond), 'f', -1, 64))
+		shared.SetDeadline(r, RevAnnotation(r.Context(), shared.SLOAnnotationKey))
+		// 积压量、pod数和容量状态都按revision分开算
+		r = r.WithContext(context.WithValue(r.Context(), shared.RevisionKey, revID.String()))
+		// 公平队列的分组键
+		r = r.WithContext(context.WithValue(r.Context(), shared.TenantKey, shared.FairKey(r, revID.Namespace, revID.Name)))
+		// 准入策略可以在revision上用注解单独指定
+		if policy := RevAnnotation(r.Context(), shared.AdmissionAnnotationKey); policy != "" {
+			r = r.WithContext(context.WithValue(r.Context(), shared.AdmissionPolicyKey, policy))
+		}
 
-			// 将所有子任务的返回内容一次性写入主ResponseWriter
-			for _, res := range results {
-				fmt.Fprint(w, res)
+		// 如果是real-world，说明收到了一个sequence，交给工作流引擎按DAG执行，所有action完成后再return
+		if strings.Contains(revID.Name, "real-world") {
+			var wf *shared.Workflow
+			if rate, err := strconv.Atoi(r.Header.Get("X-Trace-Rate")); err == nil && rate > 0 {
+				// trace回放：执行时间由负载生成器给出，不再从CDF采样
+				wf = shared.NewTraceWorkflow(rate)
+			} else {
+				wf = shared.NewSampledWorkflow(r.Header.Get("X-Workflow-Shape"))
 			}
+			// fmt.Println("\n###当前请求的sequence长度为", len(wf.Steps))
+			res := shared.RunWorkflow(h, r, wf)
+			res.WriteTo(w, r)
 			return
 		}
 
@@ -271,19 +362,28 @@ func WrapActivatorHandlerWithFullDuplex(h http.Handler, logger *zap.SugaredLogge
 		// 产生rate并记录进r的请求头
 		rate := shared.GenRate()
 		r.Header.Set("X-Rate", rate)
-		r.Header.Set("X-Arrive-Timestamp", strconv.FormatFloat(float64(time.Now().UnixNano())/float64(time.Millisecond), 'f', -1, 64))
 		r.Header.Set("X-Last-Rate", "")
-		// 创建一个用于同步的通道
-		done := make(chan struct{})
-		// 将请求加入队列，传递同步通道
-		shared.AddReq(h, w, r, done)
-		// 等待请求处理完成
+		// 一个截止时间管到底：排队、代理和这里的等待都用它
+		ctx, cancel := context.WithDeadline(r.Context(), shared.RequestDeadline(r, requestTimeout))
+		defer cancel()
+		// 用于同步的Completion，w交给它保管，直到Abandon之前这里都不能再碰w
+		done := shared.NewCompletion(w)
+		// 将请求加入队列
+		shared.EnqueueReq(h, done.Writer(), r.WithContext(ctx), done)
+		// 等待请求处理完成。客户端断开或者超时时队列会删掉这个请求并完成done，这里再等ctx只是兜底
 		select {
-		case <-done:
+		case <-done.Done():
 			// fmt.Println("###rate为", rate, "的任务已经执行完成并返回到http.HandlerFunc")
-		case <-time.After(120 * time.Second):
-			fmt.Println("###rate为", rate, "的任务整体超时，不管了直接关done通道")
-			close(done)
+		case <-ctx.Done():
+		}
+		switch outcome, canWrite := done.Abandon(); {
+		case outcome == shared.OutcomeTimedOut:
+			fmt.Println("###rate为", rate, "的任务整体超时")
+			if canWrite {
+				http.Error(w, "activator request timeout", http.StatusGatewayTimeout)
+			}
+		case outcome == shared.OutcomeQueueFull && canWrite:
+			http.Error(w, "activator queue full", http.StatusServiceUnavailable)
 		}
 	})
 }
@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// handler链的冒烟测试，链本身由activator/testing的NewHarness搭。
+// Throttler用一个只有一个pod的替身；队列满、超时、回调丢失、pod增减这些场景用真正的Throttler跑，在net的scenario_test.go里
+
+package handler_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	activatortest "knative.dev/serving/pkg/activator/testing"
+	v1 "knative.dev/serving/pkg/apis/serving/v1"
+	"knative.dev/serving/pkg/fakepod"
+	"knative.dev/serving/pkg/shared"
+)
+
+// 所有请求都发给同一个pod的Throttler
+type singlePodThrottler struct {
+	dest string
+}
+
+func (t singlePodThrottler) Try(ctx context.Context, _ types.NamespacedName, fn func(context.Context, string) error) error {
+	return fn(ctx, t.dest)
+}
+
+// 按trace回放的real-world请求：只有一个action，执行时间由X-Trace-Rate给出，不经过随机采样
+func TestHarnessServesTraceInvocation(t *testing.T) {
+	ctx := context.Background()
+	rev := &v1.Revision{}
+	rev.Namespace, rev.Name = "default", "real-world-00001"
+
+	var h *activatortest.Harness
+	callbacks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { h.Callbacks.ServeHTTP(w, r) }))
+	defer callbacks.Close()
+	pod := httptest.NewServer(fakepod.New(fakepod.Config{Mode: fakepod.ModeRealWorld, PodIP: "127.0.0.1", StoreURL: callbacks.URL + "/store"}))
+	defer pod.Close()
+	h = activatortest.NewHarness(ctx, singlePodThrottler{dest: strings.TrimPrefix(pod.URL, "http://")}, http.DefaultTransport, rev)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Trace-Rate", "5")
+	h.Handler.ServeHTTP(w, req)
+	body, _ := io.ReadAll(w.Result().Body)
+	if w.Code != http.StatusOK || len(strings.Fields(string(body))) != 5 {
+		t.Fatalf("got %d %q, want 200 with 5 fields", w.Code, body)
+	}
+	// pod在返回之前回调了/store，占用已经撤销
+	for deadline := time.Now().Add(time.Second); shared.InflightJobNum("") != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("InflightJobNum = %d after the callback, want 0", shared.InflightJobNum(""))
+		}
+	}
+}
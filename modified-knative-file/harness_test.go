@@ -0,0 +1,155 @@
+// 进程内测试用：调度相关的状态都是包级的全局变量，跟着进程走；
+// 在同一个进程里跑多个会动到这些状态的测试时，用ResetState把它们清回初始状态，保证测试之间互不影响。
+// 这些函数放在_test.go里，只有shared自己的测试能用
+
+package shared
+
+import (
+	"container/list"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// 清空队列和所有调度相关的全局状态，计数器归零。
+// 还在排队的请求按被拒绝处理，调用前应等上一个场景的请求都返回
+func ResetState() {
+	for _, u := range takeAllQueued() {
+		stopWatchCancel(u.Done)
+		http.Error(u.Writer, "activator state reset", http.StatusServiceUnavailable)
+		u.Done.Finish(OutcomeRejected)
+	}
+
+	// 队列本身已经被takeAllQueued取空了，这里把分组、索引和序号也清掉
+	EDFQueueMutex.Lock()
+	EDFQueue = nil
+	edfSeq = 0
+	EDFQueueMutex.Unlock()
+	FairQueueMutex.Lock()
+	fairTenants = make(map[string]*fairTenant)
+	fairActive.Init()
+	fairQueuedNum = 0
+	FairQueueMutex.Unlock()
+	MLFQQueueMutex.Lock()
+	mlfqQueues = make([]list.List, len(MLFQThresholds)+1)
+	mlfqQueuedNum = 0
+	MLFQQueueMutex.Unlock()
+	queuedIndexMutex.Lock()
+	queuedIndex = make(map[*Completion]*queueEntry)
+	queuedIndexMutex.Unlock()
+
+	requestStatic.Lock()
+	requestStatic.Data = make(map[string]PodInfo)
+	requestStatic.Unlock()
+
+	workflowIDMutex.Lock()
+	workflowID = 0
+	workflowIDMutex.Unlock()
+
+	walMutex.Lock()
+	walInflight = make(map[string][]walEntry)
+	walPending = make(map[string]walEntry)
+	walAppended = 0
+	walMutex.Unlock()
+
+	GlobalVarMutex.Lock()
+	TotalJobNum = 0
+	TotalExecTime = 0
+	MaxExecTime = 0
+	MaxQueueActualLen = 0
+	CancelledJobNum = 0
+	ShedJobNum = 0
+	DeferredJobNum = 0
+	EDFRejectedNum = 0
+	StolenJobNum = 0
+	HedgedJobNum = 0
+	HedgeWinJobNum = 0
+	RetriedJobNum = 0
+	EjectionNum = 0
+	PreemptedJobNum = 0
+	GlobalVarMutex.Unlock()
+
+	podNumMutex.Lock()
+	podNum = make(map[string]int)
+	podRevision = make(map[string]string)
+	podNumMutex.Unlock()
+
+	seqPodMutex.Lock()
+	seqPod = make(map[string]string)
+	seqPodMutex.Unlock()
+
+	lastRateMutex.Lock()
+	lastRate = ""
+	lastRateMutex.Unlock()
+	lastArriveTimeMutex.Lock()
+	lastArriveTime = ""
+	lastArriveTimeMutex.Unlock()
+
+	queuedWorkMutex.Lock()
+	queuedWork = make(map[string]float64)
+	queuedWorkMutex.Unlock()
+
+	cancelWatchMutex.Lock()
+	cancelWatches = make(map[*Completion]func() bool)
+	cancelWatchMutex.Unlock()
+
+	drainingMutex.Lock()
+	draining = false
+	drainingMutex.Unlock()
+
+	mlfqStatsMutex.Lock()
+	mlfqRunTime = make(map[string]float64)
+	mlfqInflight = make(map[string]mlfqDispatch)
+	mlfqDispatchID = 0
+	mlfqLastSweep = time.Time{}
+	mlfqStatsMutex.Unlock()
+
+	podNodeMutex.Lock()
+	podNode = make(map[string]string)
+	endpointPods = make(map[string]map[string]bool)
+	podNodeMutex.Unlock()
+
+	podSlotMutex.Lock()
+	podSlots = make(map[string]*podSlotQueue)
+	podSlotMutex.Unlock()
+
+	hedgeMutex.Lock()
+	hedgeSamples = hedgeSamples[:0]
+	hedgeNext = 0
+	hedgeMutex.Unlock()
+
+	suspectMutex.Lock()
+	suspectUntil = make(map[string]time.Time)
+	suspectMutex.Unlock()
+
+	outlierMutex.Lock()
+	outliers = make(map[string]*outlierState)
+	groupLatency = [10]float64{}
+	groupSamples = [10]int{}
+	outlierMutex.Unlock()
+
+	coldMutex.Lock()
+	coldStates = make(map[string]*coldRevision)
+	coldMutex.Unlock()
+
+	preemptMutex.Lock()
+	dispatchedLong = make(map[string]runningJob)
+	runningLong = make(map[string]map[string]runningJob)
+	pausedBy = make(map[string]int)
+	pausedJobs = make(map[string]*pausedGroup)
+	preemptMutex.Unlock()
+}
+
+// 往实验3，4的队列里塞n个不会到期的占位请求，用来构造队列满的场景。ResetState会把它们当作被拒绝的请求清掉
+func FillQueue(n int) {
+	QueueMutex.Lock()
+	defer QueueMutex.Unlock()
+	for i := 0; i < n; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Rate", "30")
+		done := NewCompletion(httptest.NewRecorder())
+		u := newSchedulingUnit(http.NotFoundHandler(), done.Writer(), r, done)
+		u.Timer = time.NewTimer(time.Hour)
+		pushUnit(u)
+	}
+}
@@ -0,0 +1,79 @@
+// 小任务的对冲请求（hedging）：短任务偶尔被发到正在跑长任务的pod上，响应时间会比执行时间长几个数量级。
+// 对不超过HedgeMaxRate的GET请求，发出后等待一段时间（最近观测到的响应时间的HedgePercentile分位数）还没返回，
+// 就再挑一个pod发一份，谁先返回用谁的，另一个取消。两份都经过proxyRequest的AddReqToRS，pod回调/store时各自扣掉，
+// 所以对冲出去的副本同样算在pod的负载里
+
+package shared
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 请求上下文中标记该请求需要对冲的键，由handler放进去，revisionThrottler.try读取
+const HedgeKey ContextKey = "hedge"
+
+// 不超过这个rate的任务才对冲，0表示不对冲，由main.go根据环境变量HEDGE_MAX_RATE设置
+var HedgeMaxRate = 0
+
+// 对冲的等待时间取最近响应时间的这个分位数
+var HedgePercentile = 0.95
+
+// 样本不够时使用的等待时间
+var HedgeDefaultDelay = 100 * time.Millisecond
+
+// 保留最近多少个响应时间样本，以及至少多少个样本才开始用分位数
+const (
+	hedgeWindow     = 1000
+	hedgeMinSamples = 50
+)
+
+var (
+	hedgeMutex     sync.Mutex
+	hedgeSamples   = make([]float64, 0, hedgeWindow) // 环形缓冲区，单位毫秒
+	hedgeNext      = 0
+	HedgedJobNum   = 0 // 发出了副本的请求数
+	HedgeWinJobNum = 0 // 副本先返回的请求数
+)
+
+func ShouldHedge(rate int) bool {
+	return HedgeMaxRate > 0 && rate > 0 && rate <= HedgeMaxRate
+}
+
+// /store收到回调时调用，记录一个响应时间样本（到达activator到开始执行，毫秒）
+func ObserveResponseTime(ms float64) {
+	hedgeMutex.Lock()
+	defer hedgeMutex.Unlock()
+	if len(hedgeSamples) < hedgeWindow {
+		hedgeSamples = append(hedgeSamples, ms)
+		return
+	}
+	hedgeSamples[hedgeNext] = ms
+	hedgeNext = (hedgeNext + 1) % hedgeWindow
+}
+
+// 发出副本前等待的时间
+func HedgeDelay() time.Duration {
+	hedgeMutex.Lock()
+	if len(hedgeSamples) < hedgeMinSamples {
+		hedgeMutex.Unlock()
+		return HedgeDefaultDelay
+	}
+	sorted := append([]float64(nil), hedgeSamples...)
+	hedgeMutex.Unlock()
+
+	sort.Float64s(sorted)
+	ms := sorted[int(HedgePercentile*float64(len(sorted)-1))]
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// 发出了一个副本，won表示副本先返回
+func CountHedge(won bool) {
+	GlobalVarMutex.Lock()
+	defer GlobalVarMutex.Unlock()
+	HedgedJobNum++
+	if won {
+		HedgeWinJobNum++
+	}
+}
@@ -169,6 +169,33 @@ func simpleRandomChoice2Policy() lbPolicy { // 直接用它//////////
 	}
 }
 
+// 考虑节点拓扑的早期绑定power of 2：同一节点上的pod共享CPU，比较时把节点上的积压也算进去
+func nodeAwareRandomChoice2Policy() lbPolicy {
+	var (
+		mu sync.Mutex
+	)
+	return func(ctx context.Context, targets []*podTracker) (func(), *podTracker) {
+		mu.Lock()
+		defer mu.Unlock()
+		l := len(targets)
+		if l == 1 {
+			pick := targets[0]
+			return noop, pick
+		}
+		r1, r2 := rand.Intn(l), rand.Intn(l-1)
+		if r2 >= r1 {
+			r2++
+		}
+		pick1, pick2 := targets[r1], targets[r2]
+
+		pick1ip, pick2ip := strings.Split(pick1.dest, ":")[0], strings.Split(pick2.dest, ":")[0]
+		if pick1ip == shared.ChoosePodByNode(pick1ip, pick2ip, shared.RateFromContext(ctx)) {
+			return noop, pick1
+		}
+		return noop, pick2
+	}
+}
+
 // 延迟绑定的power of 2：随机选两个，看谁先空闲就发过去
 func lateRandomChoice2Policy() lbPolicy {
 	var (
@@ -199,3 +226,90 @@ func lateRandomChoice2Policy() lbPolicy {
 		}
 	}
 }
+
+// 按pod速度折算的SITA：长任务发给快的pod，见shared.SITAPod
+func sitaPolicy() lbPolicy {
+	return func(ctx context.Context, targets []*podTracker) (func(), *podTracker) {
+		if len(targets) == 1 {
+			return noop, targets[0]
+		}
+		podips := make([]string, len(targets))
+		for i, t := range targets {
+			podips[i] = strings.Split(t.dest, ":")[0]
+		}
+		pickip := shared.SITAPod(podips, shared.RateFromContext(ctx))
+		for i, ip := range podips {
+			if ip == pickip {
+				return noop, targets[i]
+			}
+		}
+		return noop, targets[0]
+	}
+}
+
+// 可以通过环境变量LB_POLICY选择的策略，外层都套了sequence亲和（延迟绑定的除外，它本来就等pod空闲）
+var lbPolicies = map[string]func() lbPolicy{
+	"random2": func() lbPolicy { return seqAffinityPolicy(simpleRandomChoice2Policy()) },
+	"late":    lateRandomChoice2Policy,
+	"sita":    func() lbPolicy { return seqAffinityPolicy(sitaPolicy()) },
+	// 按节点均衡积压，需要private Endpoints里的节点信息
+	"node-aware": func() lbPolicy { return seqAffinityPolicy(nodeAwareRandomChoice2Policy()) },
+}
+
+var newLBPolicy = lbPolicies["random2"]
+
+// 不认识的策略名返回false，保持默认的random2
+func SetLBPolicy(name string) bool {
+	p, ok := lbPolicies[name]
+	if ok {
+		newLBPolicy = p
+	}
+	return ok
+}
+
+// 冷启动感知：小任务优先发给还没热起来的pod，长任务只发给热的pod，没有合适的pod时交给inner在所有pod中选
+func warmupAwarePolicy(inner lbPolicy) lbPolicy {
+	return func(ctx context.Context, targets []*podTracker) (func(), *podTracker) {
+		rate := shared.RateFromContext(ctx)
+		small := shared.IsWarmupProbe(rate)
+		large := shared.ExpectedExecTime(rate) >= shared.LargeJobWork
+		if !small && !large {
+			return inner(ctx, targets)
+		}
+		var cold, warm []*podTracker
+		for _, t := range targets {
+			if shared.IsPodWarm(strings.Split(t.dest, ":")[0]) {
+				warm = append(warm, t)
+			} else {
+				cold = append(cold, t)
+			}
+		}
+		if small && len(cold) > 0 {
+			return inner(ctx, cold)
+		}
+		if large && len(warm) > 0 {
+			return inner(ctx, warm)
+		}
+		return inner(ctx, targets)
+	}
+}
+
+// sequence亲和：同一条链的后续action优先放到上一个action所在的pod（已经热起来了），该pod忙的话再交给inner选
+func seqAffinityPolicy(inner lbPolicy) lbPolicy {
+	return func(ctx context.Context, targets []*podTracker) (func(), *podTracker) {
+		seqID, _ := ctx.Value(shared.SeqIDKey).(string)
+		if seqID == "" {
+			return inner(ctx, targets)
+		}
+		lastip := shared.GetSeqPod(seqID)
+		if lastip == "" || shared.CheckPodBusy(lastip) {
+			return inner(ctx, targets)
+		}
+		for _, t := range targets {
+			if strings.Split(t.dest, ":")[0] == lastip {
+				return noop, t
+			}
+		}
+		return inner(ctx, targets)
+	}
+}
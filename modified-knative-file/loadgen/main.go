@@ -0,0 +1,148 @@
+// 负载生成器，代替locustfile.py里的泊松过程，两种用法：
+//   - 按Azure Functions的trace回放real-world请求：每次调用发一个GET，X-Trace-Rate里带上trace给出的执行时间，
+//     activator据此生成只有一个action的sequence
+//   - 按-arrival给出的到达过程（见shared.ParseArrivalProcess）发请求，执行时间仍由activator采样，alu和real-world都能用
+// 返回内容和locust一样追加写到输出文件里，方便沿用原来的分析脚本。
+//
+// 用法：
+//	go run ./loadgen -url http://<ingress>:<port>/ -host real-world.default.example.com \
+//		-invocations invocations_per_function_md.anon.d01.csv -durations function_durations_percentiles.anon.d01.csv \
+//		-start 600 -end 660 -time-scale 10 -functions 200 -seed 1
+//	go run ./loadgen -url http://<ingress>:<port>/ -host alu-bench.default.example.com \
+//		-arrival onoff:rate=50,on=2s,off=10s -duration 10m
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"knative.dev/serving/pkg/shared"
+)
+
+func main() {
+	var (
+		target      = flag.String("url", "http://127.0.0.1:8080/", "请求发到的地址")
+		host        = flag.String("host", "real-world.default.example.com", "请求的Host头")
+		invocations = flag.String("invocations", "", "invocations_per_function_md.anon.dXX.csv")
+		durations   = flag.String("durations", "", "function_durations_percentiles.anon.dXX.csv")
+		out         = flag.String("out", "./tmp.txt", "返回内容追加写到这个文件")
+		timeout     = flag.Duration("timeout", 10*time.Minute, "单个请求的超时时间")
+		dryRun      = flag.Bool("dry-run", false, "只打印调用序列的统计，不发请求")
+		arrival     = flag.String("arrival", "", "到达过程，比如poisson:rate=10，给出时不读trace")
+		length      = flag.Duration("duration", 10*time.Minute, "按到达过程发请求时持续多久")
+		opts        shared.TraceOptions
+	)
+	flag.IntVar(&opts.StartMinute, "start", 0, "从trace的第几分钟开始（从0开始）")
+	flag.IntVar(&opts.EndMinute, "end", 0, "到第几分钟结束（不含），0表示到最后")
+	flag.Float64Var(&opts.TimeScale, "time-scale", 1, "时间压缩倍数，10表示trace里的1分钟回放6秒")
+	flag.IntVar(&opts.Functions, "functions", 0, "随机取这么多个函数，0表示全部")
+	flag.IntVar(&opts.MinInvocations, "min-invocations", 0, "区间内调用次数少于它的函数不参与采样")
+	flag.Float64Var(&opts.DurationScale, "duration-scale", 1, "执行时间乘以这个系数")
+	flag.BoolVar(&opts.UseAverage, "average", false, "执行时间一律用平均值，否则按百分位数采样")
+	flag.Int64Var(&opts.Seed, "seed", 1, "随机种子，到达过程也用它")
+	flag.Parse()
+
+	var schedule []shared.TraceInvocation
+	if *arrival != "" {
+		p, err := shared.ParseArrivalProcess(*arrival, rand.New(rand.NewSource(opts.Seed)))
+		if err != nil {
+			log.Fatalf("Failed to parse -arrival: %v", err)
+		}
+		for _, at := range shared.ArrivalTimes(p, *length) {
+			schedule = append(schedule, shared.TraceInvocation{At: at})
+		}
+	} else {
+		if *invocations == "" || *durations == "" {
+			log.Fatal("-invocations and -durations are required without -arrival")
+		}
+		fns, err := shared.LoadAzureTrace(*invocations, *durations)
+		if err != nil {
+			log.Fatalf("Failed to load trace: %v", err)
+		}
+		log.Printf("Loaded %d functions", len(fns))
+		schedule = shared.BuildTraceSchedule(fns, opts)
+	}
+	if len(schedule) == 0 {
+		log.Fatal("No invocations to send")
+	}
+	log.Printf("Sending %d requests over %v", len(schedule), schedule[len(schedule)-1].At)
+	if *dryRun {
+		return
+	}
+
+	f, err := os.OpenFile(*out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", *out, err)
+	}
+	defer f.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	client := &http.Client{Timeout: *timeout}
+	var (
+		wg       sync.WaitGroup
+		outMutex sync.Mutex
+		sent     atomic.Int64
+		failed   atomic.Int64
+	)
+	err = shared.ReplayTrace(ctx, schedule, func(inv shared.TraceInvocation) {
+		sent.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := invoke(client, *target, *host, inv)
+			if err != nil {
+				failed.Add(1)
+				log.Printf("%s rate %d: %v", inv.Function, inv.Rate, err)
+				return
+			}
+			outMutex.Lock()
+			defer outMutex.Unlock()
+			f.Write(body)
+		}()
+	})
+	if err != nil {
+		log.Printf("Replay stopped: %v", err)
+	}
+	wg.Wait()
+	log.Printf("Sent %d requests, %d failed", sent.Load(), failed.Load())
+}
+
+func invoke(client *http.Client, target string, host string, inv shared.TraceInvocation) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	if inv.Rate > 0 {
+		req.Header.Set("X-Trace-Rate", strconv.Itoa(inv.Rate))
+		// 和MLFQKey读的是同一个头，MLFQ据此按函数统计运行时间
+		req.Header.Set("X-Function", inv.Function)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
@@ -19,10 +19,9 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"strings"
 
 	"log"
 	"net/http"
@@ -78,6 +77,10 @@ const (
 
 	// The port on which autoscaler WebSocket server listens.
 	autoscalerPort = ":8080"
+
+	// How long to wait for queued and in-flight jobs when draining. This has to
+	// fit into the activator's terminationGracePeriodSeconds (600s).
+	drainTimeout = 300 * time.Second
 )
 
 type config struct {
@@ -211,28 +214,14 @@ func main() {
 
 	// 启动HTTP接收端，异步接收并记录外部HTTP请求
 	go func() {
-		http.HandleFunc("/store", func(w http.ResponseWriter, r *http.Request) {
-			body, err := io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-				return
-			}
-			defer r.Body.Close()
-
-			bodyNumList := strings.Split(string(body), " ")
-			rate, _ := strconv.Atoi(bodyNumList[2]) // 理论的执行时间
-			podip := r.Header.Get("X-PodIP")
-			shared.DelReqFromRS(podip, rate)
-
-			// 下面是实验4将任务执行时间添加到全局变量中的代码，实验3中因为知道rate，所以在handler.go的proxyRequest函数做了这个
-			// lat, _ := strconv.ParseFloat(bodyNumList[3], 64)
-			// resp, _ := strconv.ParseFloat(bodyNumList[1], 64)
-			// runningTime := lat - resp
-			// shared.AddJobToGlobalVar(runningTime)
-
-			// fmt.Println("将请求从RS中删除", podip, rate)
-			w.WriteHeader(http.StatusOK)
-			// w.Write([]byte("Request stored"))
+		http.HandleFunc("/store", activatorhandler.NewStoreHandler(logger))
+		// pod开始执行长任务时回调，确认之后才能暂停它
+		http.HandleFunc("/start", activatorhandler.NewStartHandler())
+
+		// 输出调度相关的计数（取消、拒绝、积压量等）
+		http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(shared.Stats())
 		})
 
 		if err := http.ListenAndServe(":8081", nil); err != nil {
@@ -240,11 +229,68 @@ func main() {
 		}
 	}()
 
-	// 处理队列中的请求，调换顺序等等
-	go shared.ManageQueue()
+	// 后台探测pod实际并发的间隔和信任程度，见throttler的probePods
+	if interval, err := time.ParseDuration(os.Getenv("POD_PROBE_INTERVAL")); err == nil {
+		shared.PodProbeInterval = interval
+	}
+	if trust, err := strconv.ParseFloat(os.Getenv("POD_PROBE_TRUST"), 64); err == nil {
+		shared.PodProbeTrust = trust
+	}
+
+	shared.WorkStealing = os.Getenv("WORK_STEALING") == "true"
+	shared.WarmupAware = os.Getenv("WARMUP_AWARE") == "true"
+	shared.PreemptRunning = os.Getenv("PREEMPT_RUNNING") == "true"
+	if port, err := strconv.Atoi(os.Getenv("POD_CONTROL_PORT")); err == nil {
+		shared.PodControlPort = port
+	}
+	if retries, err := strconv.Atoi(os.Getenv("POD_RETRIES")); err == nil {
+		shared.MaxPodRetries = retries
+	}
+	if maxRate, err := strconv.Atoi(os.Getenv("HEDGE_MAX_RATE")); err == nil {
+		shared.HedgeMaxRate = maxRate
+	}
+	// 负载均衡策略，默认是random2（按ratesum比较的power of 2）
+	if policy := os.Getenv("LB_POLICY"); policy != "" && !activatornet.SetLBPolicy(policy) {
+		logger.Warnf("Unknown LB_POLICY %q, falling back to random2", policy)
+	}
+
+	// 打开预写日志，回放重启前的在途任务，重建pod占用情况
+	if walPath := os.Getenv("QUEUE_WAL_PATH"); walPath != "" {
+		report, err := shared.OpenWAL(walPath)
+		if err != nil {
+			logger.Errorw("Failed to open queue WAL, continuing without it", zap.Error(err))
+		} else {
+			logger.Infof("Replayed queue WAL %s: %v", walPath, report)
+			defer shared.CloseWAL()
+		}
+	}
+
+	// 处理队列中的请求，调换顺序等等。队列模式由环境变量QUEUE_MODE指定，默认是实验3，4
+	if mode := os.Getenv("QUEUE_MODE"); mode != "" && !shared.SetQueueMode(mode) {
+		logger.Warnf("Unknown QUEUE_MODE %q, falling back to the default queue", mode)
+	}
+	if policy := os.Getenv("ADMISSION_POLICY"); policy != "" {
+		shared.DefaultAdmissionPolicy = policy
+	}
+	if by := os.Getenv("FAIR_QUEUE_BY"); by != "" {
+		shared.FairQueueBy = by
+	}
+	if weights := os.Getenv("FAIR_QUEUE_WEIGHTS"); weights != "" {
+		shared.FairQueueWeights = shared.ParseFairQueueWeights(weights)
+	}
+	if dist := os.Getenv("SEQ_IAT_DIST"); dist != "" {
+		shared.SeqIATDistribution = dist
+	}
+	go shared.RunQueue()
 
 	// Create and run our concurrency reporter
-	concurrencyReporter := activatorhandler.NewConcurrencyReporter(ctx, env.PodName, statCh)
+	// 打开WORK_WEIGHTED_CONCURRENCY时，并发数在发给autoscaler之前换成按预计工作量折算的值
+	reporterCh := statCh
+	if os.Getenv("WORK_WEIGHTED_CONCURRENCY") == "true" {
+		reporterCh = make(chan []asmetrics.StatMessage)
+		go weightStatsByWork(reporterCh, statCh)
+	}
+	concurrencyReporter := activatorhandler.NewConcurrencyReporter(ctx, env.PodName, reporterCh)
 	go concurrencyReporter.Run(ctx.Done())
 
 	// Create activation handler chain
@@ -344,12 +390,19 @@ func main() {
 	case err := <-errCh:
 		logger.Errorw("Failed to run HTTP server", zap.Error(err))
 	}
+	// 不再往自定义队列里放新请求
+	shared.StopAccepting()
 
 	// The drain has started (we are now failing readiness probes).  Let the effects of this
 	// propagate so that new requests are no longer routed our way.
 	logger.Infof("Sleeping %v to allow K8s propagation of non-ready state", pkgnet.DefaultDrainTimeout)
 	time.Sleep(pkgnet.DefaultDrainTimeout)
-	logger.Info("Done waiting, shutting down servers.")
+	logger.Info("Done waiting, draining the request queue.")
+
+	// 清空自定义队列，并等在途任务跑完（最长的任务也能在drainTimeout内跑完）
+	report := shared.Drain(drainTimeout)
+	logger.Infof("Request queue drained: %v", report)
+	logger.Info("Shutting down servers.")
 
 	// Drain outstanding requests, and stop accepting new ones.
 	for _, server := range servers {
@@ -375,6 +428,18 @@ func newHealthCheck(sigCtx context.Context, logger *zap.SugaredLogger, statSink
 	}
 }
 
+// 1单位和8000单位的ALU任务在请求并发数里是一样的，autoscaler看不出重尾负载的积压。这里把每批统计中
+// 每个revision的并发数换成它在自定义队列和requestStatic里的预计工作量（秒），请求数等其他字段不变
+func weightStatsByWork(in <-chan []asmetrics.StatMessage, out chan<- []asmetrics.StatMessage) {
+	for msgs := range in {
+		for i := range msgs {
+			// 和handler放进上下文的revision一样是namespace/name
+			msgs[i].Stat.AverageConcurrentRequests = shared.WorkWeightedConcurrency(msgs[i].Key.String())
+		}
+		out <- msgs
+	}
+}
+
 func flush(logger *zap.SugaredLogger) {
 	logger.Sync()
 	os.Stdout.Sync()
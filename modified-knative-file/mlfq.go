@@ -0,0 +1,182 @@
+// 多级反馈队列（MLFQ）：不依赖X-Rate这样的先验任务大小。同一个函数（X-Function请求头，没有就用Host+路径）
+// 的请求按其历史运行时间分级，没见过的函数从最高优先级开始，历史运行时间越长级别越低，
+// 相当于不用预言机也能近似短作业优先。运行时间从proxyRequest发出请求算起，到pod回调/store为止
+
+package shared
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 各级的运行时间上限（毫秒），历史运行时间不小于MLFQThresholds[i]的函数至少落在第i+1级
+var MLFQThresholds = []float64{50, 500, 5000}
+
+// 在低级别队列中等待超过这么久的请求直接提到最高级别，防止饿死
+var MLFQBoostAfter = 30 * time.Second
+
+// 历史运行时间EWMA的平滑系数
+const mlfqAlpha = 0.3
+
+// 发出超过这么久还没回调的记录认为回调丢了，直接清掉；比单个action的超时时间长，正常的回调不会被误删
+var MLFQDispatchTTL = 10 * time.Minute
+
+func MLFQKey(r *http.Request) string {
+	if f := r.Header.Get("X-Function"); f != "" {
+		return f
+	}
+	return r.Host + r.URL.Path
+}
+
+type mlfqDispatch struct {
+	key  string
+	sent time.Time
+}
+
+var (
+	mlfqStatsMutex sync.Mutex
+	mlfqRunTime    = make(map[string]float64)      // 每个函数运行时间的EWMA（毫秒）
+	mlfqInflight   = make(map[string]mlfqDispatch) // 已发出、还没收到/store回调的请求，键是X-Dispatch-ID
+	mlfqDispatchID = 0
+	mlfqLastSweep  time.Time
+)
+
+// proxyRequest发出请求时调用，返回的ID要放进X-Dispatch-ID请求头，pod回调/store时原样带回来
+func MarkDispatched(key string) string {
+	mlfqStatsMutex.Lock()
+	defer mlfqStatsMutex.Unlock()
+	now := time.Now()
+	// 顺便清掉回调丢了的记录，每隔TTL的十分之一扫一遍
+	if now.Sub(mlfqLastSweep) > MLFQDispatchTTL/10 {
+		for id, d := range mlfqInflight {
+			if now.Sub(d.sent) > MLFQDispatchTTL {
+				delete(mlfqInflight, id)
+			}
+		}
+		mlfqLastSweep = now
+	}
+	mlfqDispatchID++
+	id := strconv.Itoa(mlfqDispatchID)
+	mlfqInflight[id] = mlfqDispatch{key: key, sent: now}
+	return id
+}
+
+// 请求没有到达pod（发送失败、被取消、对冲输了）时调用，不会再有回调，记录直接删掉，也不计入运行时间
+func ForgetDispatch(id string) {
+	mlfqStatsMutex.Lock()
+	defer mlfqStatsMutex.Unlock()
+	delete(mlfqInflight, id)
+}
+
+// /store收到回调时调用，更新该函数的历史运行时间
+func MarkCompleted(id string) {
+	mlfqStatsMutex.Lock()
+	defer mlfqStatsMutex.Unlock()
+	d, ok := mlfqInflight[id]
+	if !ok {
+		return
+	}
+	delete(mlfqInflight, id)
+	runTime := float64(time.Since(d.sent)) / float64(time.Millisecond)
+	if old, ok := mlfqRunTime[d.key]; ok {
+		mlfqRunTime[d.key] = mlfqAlpha*runTime + (1-mlfqAlpha)*old
+	} else {
+		mlfqRunTime[d.key] = runTime
+	}
+}
+
+// 函数所在的级别，0最高。没见过的函数在第0级
+func MLFQLevel(key string) int {
+	mlfqStatsMutex.Lock()
+	runTime, ok := mlfqRunTime[key]
+	mlfqStatsMutex.Unlock()
+	if !ok {
+		return 0
+	}
+	for i, t := range MLFQThresholds {
+		if runTime < t {
+			return i
+		}
+	}
+	return len(MLFQThresholds)
+}
+
+type mlfqItem struct {
+	u       SchedulingUnit
+	arrived time.Time
+}
+
+var (
+	mlfqQueues     = make([]list.List, len(MLFQThresholds)+1)
+	mlfqQueuedNum  = 0
+	MLFQQueueMutex sync.Mutex
+	MLFQQueueCond  = sync.NewCond(&MLFQQueueMutex)
+)
+
+func AddReqMLFQ(h http.Handler, w http.ResponseWriter, r *http.Request, done *Completion) {
+	u := newSchedulingUnit(h, w, withSchedulingDone(r), done)
+	level := MLFQLevel(MLFQKey(r))
+
+	MLFQQueueMutex.Lock()
+	defer MLFQQueueMutex.Unlock()
+
+	if mlfqQueuedNum >= MaxQueueize {
+		queueFull(u)
+		return
+	}
+	if mlfqQueuedNum > MaxQueueActualLen {
+		MaxQueueActualLen = mlfqQueuedNum
+	}
+	entry := enqueueEntry(&u, &MLFQQueueMutex)
+	e := mlfqQueues[level].PushBack(mlfqItem{u: u, arrived: time.Now()})
+	entry.remove = func() SchedulingUnit {
+		mlfqQueues[level].Remove(e)
+		mlfqQueuedNum--
+		return u
+	}
+	mlfqQueuedNum++
+	MLFQQueueCond.Signal()
+}
+
+// 调用者需持有MLFQQueueMutex，且至少有一个请求在排队
+func popMLFQ() SchedulingUnit {
+	// 先看低级别队列里有没有等太久的
+	for level := len(mlfqQueues) - 1; level > 0; level-- {
+		if e := mlfqQueues[level].Front(); e != nil && time.Since(e.Value.(mlfqItem).arrived) > MLFQBoostAfter {
+			return takeMLFQLocked(level, e)
+		}
+	}
+	for level := range mlfqQueues {
+		if e := mlfqQueues[level].Front(); e != nil {
+			return takeMLFQLocked(level, e)
+		}
+	}
+	return SchedulingUnit{}
+}
+
+// 调用者需持有MLFQQueueMutex
+func takeMLFQLocked(level int, e *list.Element) SchedulingUnit {
+	u := e.Value.(mlfqItem).u
+	u.take()
+	mlfqQueues[level].Remove(e)
+	return u
+}
+
+// 每次取最高级别队列的队头serve，等它被调度到pod上再取下一个
+func ManageQueueMLFQ() {
+	for {
+		MLFQQueueMutex.Lock()
+		for mlfqQueuedNum == 0 {
+			MLFQQueueCond.Wait()
+		}
+		u := popMLFQ()
+		mlfqQueuedNum--
+		MLFQQueueMutex.Unlock()
+
+		go serveRequest(u)
+		waitScheduled(u)
+	}
+}
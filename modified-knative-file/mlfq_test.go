@@ -0,0 +1,42 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMLFQDispatchCleanup(t *testing.T) {
+	t.Cleanup(func() {
+		mlfqInflight = make(map[string]mlfqDispatch)
+		mlfqRunTime = make(map[string]float64)
+		mlfqLastSweep = time.Time{}
+		suspectUntil = make(map[string]time.Time)
+	})
+
+	// 发送失败回滚的记录删掉，且不计入运行时间
+	id := MarkDispatched("fn-rollback")
+	RollbackDispatch("10.0.0.9", 100, id)
+	if _, ok := mlfqInflight[id]; ok {
+		t.Errorf("dispatch %s still tracked after RollbackDispatch", id)
+	}
+	MarkCompleted(id)
+	if _, ok := mlfqRunTime["fn-rollback"]; ok {
+		t.Error("rolled back dispatch was counted as a run")
+	}
+
+	// 回调丢了的记录过了TTL之后被扫掉
+	lost := MarkDispatched("fn-lost")
+	mlfqStatsMutex.Lock()
+	d := mlfqInflight[lost]
+	d.sent = time.Now().Add(-2 * MLFQDispatchTTL)
+	mlfqInflight[lost] = d
+	mlfqLastSweep = time.Time{}
+	mlfqStatsMutex.Unlock()
+	fresh := MarkDispatched("fn-fresh")
+	if _, ok := mlfqInflight[lost]; ok {
+		t.Errorf("dispatch %s older than the TTL was not swept", lost)
+	}
+	if _, ok := mlfqInflight[fresh]; !ok {
+		t.Errorf("fresh dispatch %s was swept", fresh)
+	}
+}
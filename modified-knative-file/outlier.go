@@ -0,0 +1,138 @@
+// 被动异常检测：podTracker的breaker只管并发，一个一直返回5xx或者特别慢的pod照样会被所有lbPolicy选中。
+// 这里按pod统计连续的5xx（proxyRequest看到的状态码）和连续的慢任务（/store回调的执行时间远超同一长短组的平均值），
+// 达到OutlierConsecutive次就把pod暂时踢出，revisionThrottler选pod时跳过它。被踢出的时间按被踢的次数指数增长，
+// pod恢复正常一段时间之后次数清零
+
+package shared
+
+import (
+	"sync"
+	"time"
+)
+
+// 连续多少次5xx或者慢任务就踢出
+var OutlierConsecutive = 5
+
+// 执行时间超过同组平均值的这么多倍算慢
+var OutlierLatencyFactor = 5.0
+
+// 第一次踢出的时长，之后每次翻倍，最长OutlierMaxEjection
+var (
+	OutlierBaseEjection = 30 * time.Second
+	OutlierMaxEjection  = 5 * time.Minute
+)
+
+// 每组执行时间EWMA的平滑系数，以及至少多少个样本才开始判断慢
+const (
+	outlierAlpha      = 0.1
+	outlierMinSamples = 20
+)
+
+type outlierState struct {
+	consecutive5xx  int
+	consecutiveSlow int
+	ejections       int
+	ejectedUntil    time.Time
+}
+
+var (
+	outlierMutex sync.Mutex
+	outliers     = make(map[string]*outlierState) // pod的ip -> 状态
+	groupLatency [10]float64                      // 每个长短组在所有pod上的执行时间EWMA（毫秒）
+	groupSamples [10]int
+	EjectionNum  = 0 // 踢出pod的次数
+)
+
+// 调用者需持有outlierMutex
+func outlierLocked(podip string) *outlierState {
+	s, ok := outliers[podip]
+	if !ok {
+		s = &outlierState{}
+		outliers[podip] = s
+	}
+	return s
+}
+
+// 调用者需持有outlierMutex
+func ejectLocked(s *outlierState) {
+	now := time.Now()
+	// 上次踢出结束后正常了足够久，就从头算
+	if now.Sub(s.ejectedUntil) > OutlierMaxEjection {
+		s.ejections = 0
+	}
+	d := OutlierBaseEjection << s.ejections
+	if d > OutlierMaxEjection || d <= 0 {
+		d = OutlierMaxEjection
+	}
+	s.ejections++
+	s.ejectedUntil = now.Add(d)
+	s.consecutive5xx = 0
+	s.consecutiveSlow = 0
+
+	GlobalVarMutex.Lock()
+	EjectionNum++
+	GlobalVarMutex.Unlock()
+}
+
+// proxyRequest收到pod的响应（或者连接失败，按502算）后调用
+func ReportPodStatus(podip string, status int) {
+	outlierMutex.Lock()
+	defer outlierMutex.Unlock()
+	s := outlierLocked(podip)
+	if status < 500 {
+		s.consecutive5xx = 0
+		return
+	}
+	s.consecutive5xx++
+	if s.consecutive5xx >= OutlierConsecutive {
+		ejectLocked(s)
+	}
+}
+
+// /store收到回调时调用，runTime是实际执行时间（毫秒）
+func ReportPodLatency(podip string, rate int, runTime float64) {
+	// 和AddReqToRS一样按rate分组，ALU的8000按执行时间算的话会落到所有分组之外
+	index := GetGroupIndex(rate)
+	if index == -1 || runTime <= 0 {
+		return
+	}
+	outlierMutex.Lock()
+	defer outlierMutex.Unlock()
+	s := outlierLocked(podip)
+	if groupSamples[index] >= outlierMinSamples && runTime > OutlierLatencyFactor*groupLatency[index] {
+		s.consecutiveSlow++
+		if s.consecutiveSlow >= OutlierConsecutive {
+			ejectLocked(s)
+		}
+	} else {
+		s.consecutiveSlow = 0
+	}
+
+	if groupSamples[index] == 0 {
+		groupLatency[index] = runTime
+	} else {
+		groupLatency[index] = outlierAlpha*runTime + (1-outlierAlpha)*groupLatency[index]
+	}
+	groupSamples[index]++
+}
+
+func IsPodEjected(podip string) bool {
+	outlierMutex.Lock()
+	defer outlierMutex.Unlock()
+	s, ok := outliers[podip]
+	return ok && time.Now().Before(s.ejectedUntil)
+}
+
+// 当前被踢出的pod数
+func EjectedPodNum() int {
+	outlierMutex.Lock()
+	defer outlierMutex.Unlock()
+	now := time.Now()
+	num := 0
+	for _, s := range outliers {
+		if now.Before(s.ejectedUntil) {
+			num++
+		}
+	}
+	return num
+}
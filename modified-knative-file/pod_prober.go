@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// 后台定期从每个pod的queue-proxy指标接口读取实际的并发请求数，和requestStatic中靠/store回调维护的
+// 任务数做对账。回调丢失或者任务超时都会让requestStatic里的ratesum一直不为0，CheckPodBusy/ChooseIdlePod
+// 就会把一个其实空闲的pod永远当成忙的
+
+package net
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"knative.dev/serving/pkg/networking"
+	"knative.dev/serving/pkg/shared"
+)
+
+// queue-proxy在这个指标里报告最近一个统计窗口内的平均并发请求数。这是平均值，刚发出去的任务还反映不出来，
+// 所以shared.ReconcilePod不会删最近一个探测间隔内发出的任务
+const queueConcurrencyMetric = "queue_average_concurrent_requests"
+
+// 单个pod的探测超时
+const podProbeTimeout = time.Second
+
+// probePods定期探测所有revision的所有pod，直到ctx结束。shared.PodProbeInterval为0时不探测
+func (t *Throttler) probePods(ctx context.Context, transport http.RoundTripper) {
+	if shared.PodProbeInterval <= 0 {
+		return
+	}
+	client := &http.Client{Transport: transport, Timeout: podProbeTimeout}
+	ticker := time.NewTicker(shared.PodProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, dest := range t.podDests() {
+				podip := strings.Split(dest, ":")[0]
+				concurrency, err := probePodConcurrency(ctx, client, podip)
+				if err != nil {
+					t.logger.Debugw("Failed to probe pod concurrency", zap.String("pod", podip), zap.Error(err))
+					continue
+				}
+				shared.ReconcilePod(podip, concurrency)
+			}
+		}
+	}
+}
+
+// 所有revision当前的pod地址
+func (t *Throttler) podDests() []string {
+	t.revisionThrottlersMutex.RLock()
+	defer t.revisionThrottlersMutex.RUnlock()
+	var dests []string
+	for _, rt := range t.revisionThrottlers {
+		rt.mux.RLock()
+		for _, tracker := range rt.podTrackers {
+			dests = append(dests, tracker.dest)
+		}
+		rt.mux.RUnlock()
+	}
+	return dests
+}
+
+// 读取pod的queue-proxy在自动扩缩容指标端口上以Prometheus文本格式暴露的并发数
+func probePodConcurrency(ctx context.Context, client *http.Client, podip string) (float64, error) {
+	url := "http://" + podip + ":" + strconv.Itoa(networking.AutoscalingQueueMetricsPort) + "/metrics"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected probe status %d", resp.StatusCode)
+	}
+
+	return parseQueueConcurrency(resp.Body)
+}
+
+// 从Prometheus文本格式里找出并发数。指标名要完整匹配，
+// queue_average_concurrent_requests_xxx之类以它为前缀的别的指标和# HELP、# TYPE注释行都要跳过
+func parseQueueConcurrency(body io.Reader) (float64, error) {
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		rest, ok := strings.CutPrefix(line, queueConcurrencyMetric)
+		if !ok || (!strings.HasPrefix(rest, "{") && !strings.HasPrefix(rest, " ")) {
+			continue
+		}
+		// 形如 queue_average_concurrent_requests{...} 1.5，可能还带一个时间戳
+		if i := strings.LastIndex(rest, "}"); i >= 0 {
+			rest = rest[i+1:]
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return 0, fmt.Errorf("metric %s has no value", queueConcurrencyMetric)
+		}
+		return strconv.ParseFloat(fields[0], 64)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("metric %s not found", queueConcurrencyMetric)
+}
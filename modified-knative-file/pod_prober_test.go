@@ -0,0 +1,29 @@
+package net
+
+import (
+	"strings"
+	"testing"
+)
+
+// queue-proxy的/metrics返回体的一部分
+const sampleQueueMetrics = `# HELP queue_average_concurrent_requests_total Made-up metric sharing the prefix
+queue_average_concurrent_requests_total{namespace_name="default"} 42
+# HELP queue_average_concurrent_requests Average of requests currently being handled by this pod
+# TYPE queue_average_concurrent_requests gauge
+queue_average_concurrent_requests{configuration_name="alu-bench",namespace_name="default",pod_name="alu-bench-00001-deployment-5d9c",revision_name="alu-bench-00001",service_name="alu-bench"} 1.5 1700000000000
+queue_average_proxied_concurrent_requests{configuration_name="alu-bench",namespace_name="default",pod_name="alu-bench-00001-deployment-5d9c",revision_name="alu-bench-00001",service_name="alu-bench"} 1
+`
+
+func TestParseQueueConcurrency(t *testing.T) {
+	got, err := parseQueueConcurrency(strings.NewReader(sampleQueueMetrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1.5 {
+		t.Errorf("concurrency = %v, want 1.5", got)
+	}
+
+	if _, err := parseQueueConcurrency(strings.NewReader("queue_requests_per_second 3\n")); err == nil {
+		t.Error("missing metric did not return an error")
+	}
+}
@@ -0,0 +1,192 @@
+// 真正的抢占：AddReq12/AddReq里的“抢占”只是让短任务不用排队，正在pod上跑的8000单位任务是停不下来的。
+// 基准服务提供了协作式的控制接口：POST /preempt?id=<X-Dispatch-ID> 让该任务的alu()循环在下一个检查点停下，
+// POST /resume?id=<X-Dispatch-ID> 让它继续（pod那边停太久也会自己继续，免得activator挂了任务永远卡住）。
+// 打开PreemptRunning后，短任务被发到正在跑长任务的pod上时，先暂停这个pod上的长任务，短任务返回后再恢复。
+// 长任务要等pod回调/start?id=<X-Dispatch-ID>确认开始执行之后才会被暂停，没有这个回调的服务不会被暂停
+
+package shared
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 是否暂停正在执行的长任务，由main.go根据环境变量PREEMPT_RUNNING设置
+var PreemptRunning = false
+
+// 预计执行时间不超过这个值（毫秒）的任务可以暂停别人，不小于LargeJobWork的任务可以被暂停
+var PreemptMaxWork = 200.0
+
+// 发往pod的控制请求
+type PodControlClient struct {
+	client *http.Client
+}
+
+func NewPodControlClient(timeout time.Duration) *PodControlClient {
+	return &PodControlClient{client: &http.Client{Timeout: timeout}}
+}
+
+// 控制请求直接发给用户容器的端口，不经过queue-proxy：queue-proxy按containerConcurrency限流，
+// 控制请求会排在正在跑的长任务后面，等长任务跑完才轮到它。由main.go根据环境变量POD_CONTROL_PORT设置
+var PodControlPort = 8080
+
+// dest是反向代理用的ip:port（queue-proxy的端口），换成用户容器的端口
+func UserContainerDest(dest string) string {
+	host, _, err := net.SplitHostPort(dest)
+	if err != nil {
+		host = dest
+	}
+	return net.JoinHostPort(host, strconv.Itoa(PodControlPort))
+}
+
+func (c *PodControlClient) call(ctx context.Context, dest string, action string, dispatchID string) error {
+	u := "http://" + UserContainerDest(dest) + "/" + action + "?id=" + url.QueryEscape(dispatchID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s on %s: status %d", action, dispatchID, dest, resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *PodControlClient) Preempt(ctx context.Context, dest string, dispatchID string) error {
+	return c.call(ctx, dest, "preempt", dispatchID)
+}
+
+func (c *PodControlClient) Resume(ctx context.Context, dest string, dispatchID string) error {
+	return c.call(ctx, dest, "resume", dispatchID)
+}
+
+type runningJob struct {
+	podip string
+	dest  string
+	id    string
+}
+
+// 一次暂停：暂停请求是异步发的，恢复要等暂停请求都发完，免得恢复比暂停先到
+type pausedGroup struct {
+	jobs   []runningJob
+	paused chan struct{}
+}
+
+var (
+	podControl = NewPodControlClient(time.Second)
+
+	preemptMutex   sync.Mutex
+	dispatchedLong = make(map[string]runningJob)            // 已经发出、pod还没确认开始执行的长任务，键是X-Dispatch-ID
+	runningLong    = make(map[string]map[string]runningJob) // pod的ip -> 正在执行的长任务，键是X-Dispatch-ID
+	pausedBy       = make(map[string]int)                   // pod的ip -> 正在暂停它的短任务数
+	pausedJobs     = make(map[string]*pausedGroup)          // pod的ip -> 被暂停的长任务
+
+	PreemptedJobNum = 0 // 被暂停过的长任务数
+)
+
+// proxyRequest发出请求时调用，记下发出的长任务，返回的函数在请求返回后调用。
+// 任务可能还在queue-proxy里排队，pod确认开始执行（AckRunning）之后才能被暂停
+func TrackRunning(podip string, dest string, dispatchID string, rate int) func() {
+	if !PreemptRunning || ExpectedExecTime(rate) < LargeJobWork {
+		return func() {}
+	}
+	preemptMutex.Lock()
+	defer preemptMutex.Unlock()
+	dispatchedLong[dispatchID] = runningJob{podip: podip, dest: dest, id: dispatchID}
+	return func() {
+		preemptMutex.Lock()
+		defer preemptMutex.Unlock()
+		delete(dispatchedLong, dispatchID)
+		delete(runningLong[podip], dispatchID)
+		if len(runningLong[podip]) == 0 {
+			delete(runningLong, podip)
+		}
+	}
+}
+
+// pod开始执行任务时回调/start，带回X-Dispatch-ID，长任务从这时起才算在pod上跑着
+func AckRunning(dispatchID string) {
+	preemptMutex.Lock()
+	defer preemptMutex.Unlock()
+	job, ok := dispatchedLong[dispatchID]
+	if !ok {
+		return
+	}
+	delete(dispatchedLong, dispatchID)
+	if runningLong[job.podip] == nil {
+		runningLong[job.podip] = make(map[string]runningJob)
+	}
+	runningLong[job.podip][dispatchID] = job
+}
+
+// 短任务发给podip之前调用：暂停pod上正在跑的长任务，返回的函数在短任务返回后调用，最后一个短任务返回时恢复。
+// 控制请求都是异步发的，不耽误短任务本身。
+// direct为true表示pod上有被暂停的长任务，短任务要绕过queue-proxy直接发给用户容器（见UserContainerDest）：
+// 被暂停的长任务还占着queue-proxy的并发名额，containerConcurrency为1时短任务会排在它后面，两个都跑不了
+func PreemptFor(ctx context.Context, podip string, rate int) (resume func(), direct bool) {
+	if !PreemptRunning || ExpectedExecTime(rate) > PreemptMaxWork {
+		return func() {}, false
+	}
+	preemptMutex.Lock()
+	if len(runningLong[podip]) == 0 && pausedBy[podip] == 0 {
+		preemptMutex.Unlock()
+		return func() {}, false
+	}
+	pausedBy[podip]++
+	if pausedBy[podip] == 1 {
+		group := &pausedGroup{paused: make(chan struct{})}
+		for _, job := range runningLong[podip] {
+			group.jobs = append(group.jobs, job)
+		}
+		pausedJobs[podip] = group
+		// 短任务的上下文取消了也要发完，否则恢复时不知道哪些暂停成功了
+		go func() {
+			defer close(group.paused)
+			for _, job := range group.jobs {
+				if err := podControl.Preempt(context.WithoutCancel(ctx), job.dest, job.id); err != nil {
+					fmt.Println("暂停任务失败：", err)
+					continue
+				}
+				GlobalVarMutex.Lock()
+				PreemptedJobNum++
+				GlobalVarMutex.Unlock()
+			}
+		}()
+	}
+	preemptMutex.Unlock()
+
+	return func() {
+		preemptMutex.Lock()
+		pausedBy[podip]--
+		var group *pausedGroup
+		if pausedBy[podip] == 0 {
+			group = pausedJobs[podip]
+			delete(pausedJobs, podip)
+			delete(pausedBy, podip)
+		}
+		preemptMutex.Unlock()
+		if group == nil {
+			return
+		}
+
+		// 短任务的上下文可能已经取消了，恢复不能受它影响
+		go func() {
+			<-group.paused
+			for _, job := range group.jobs {
+				if err := podControl.Resume(context.Background(), job.dest, job.id); err != nil {
+					fmt.Println("恢复任务失败：", err)
+				}
+			}
+		}()
+	}, true
+}
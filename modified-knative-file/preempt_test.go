@@ -0,0 +1,68 @@
+package shared
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// 长任务在pod确认开始执行之前不会被暂停；确认之后暂停和恢复都按顺序发到用户容器的端口上
+func TestPreemptWaitsForAck(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	pod := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, r.URL.Path+"?"+r.URL.RawQuery)
+	}))
+	defer pod.Close()
+	host, port, _ := net.SplitHostPort(pod.Listener.Addr().String())
+	oldPort, oldRunning := PodControlPort, PreemptRunning
+	PodControlPort, _ = strconv.Atoi(port)
+	PreemptRunning = true
+	t.Cleanup(func() { PodControlPort, PreemptRunning = oldPort, oldRunning })
+
+	// dest是queue-proxy的端口，控制请求不能发到那里
+	untrack := TrackRunning(host, host+":8012", "long-1", 8000)
+	defer untrack()
+	resume, direct := PreemptFor(context.Background(), host, 1)
+	resume()
+	if direct {
+		t.Error("short job sent around queue-proxy although nothing was paused")
+	}
+	mu.Lock()
+	if len(calls) != 0 {
+		t.Errorf("control calls before ack = %v, want none", calls)
+	}
+	mu.Unlock()
+
+	AckRunning("long-1")
+	ctx, cancel := context.WithCancel(context.Background())
+	resume, direct = PreemptFor(ctx, host, 1)
+	// 长任务被暂停了，短任务绕过queue-proxy发到用户容器的端口上
+	if !direct {
+		t.Error("short job not sent around queue-proxy while the long job is paused")
+	}
+	if got := UserContainerDest(host + ":8012"); got != pod.Listener.Addr().String() {
+		t.Errorf("UserContainerDest = %q, want %q", got, pod.Listener.Addr().String())
+	}
+	// 短任务的上下文取消了，暂停和恢复也要发完
+	cancel()
+	resume()
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(calls) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if calls[0] != "/preempt?id=long-1" || calls[1] != "/resume?id=long-1" {
+		t.Errorf("control calls = %v, want preempt then resume", calls)
+	}
+}
@@ -15,8 +15,100 @@ type SchedulingUnit struct {
 	Handler http.Handler
 	Writer  http.ResponseWriter
 	Req     *http.Request
-	Done    chan struct{} // 用于通知请求执行完成的通道，执行完了HandlerFunc才能关闭，否则会丢失上下文
-	Timer   *time.Timer   // 新增字段，用于计时
+	Done    *Completion // 用于通知请求执行完成，见completion.go
+	Timer   *time.Timer // 新增字段，用于计时
+
+	// sequence上下文，不属于sequence的请求SeqID为空
+	SeqID        string
+	SeqStep      int     // 在sequence中的下标
+	SeqRemaining float64 // 包括本action在内，整条链剩余的预计执行时间
+
+	Deadline time.Time // SLO截止时间，零值表示没有截止时间
+	Work     float64   // 预计执行时间（毫秒）
+	Revision string    // 所属revision（namespace/name），见RevisionKey
+
+	entry *queueEntry // 在队列里的这一次排队，见enqueueEntry
+}
+
+// 请求在某个队列（或冷启动缓冲区）里的一次排队。ManageQueue会在放开锁之后继续拿着*list.Element，
+// 期间这个元素可能已经被取消或退出流程删掉了，所以任何一方把请求从队列里取走时都要在队列的锁里把removed置位，
+// 只有第一个置位的一方能处理这个请求，ManageQueue重新加锁后据此跳过
+type queueEntry struct {
+	mu      sync.Locker           // 所在队列的锁
+	removed bool                  // 由mu保护
+	remove  func() SchedulingUnit // 从所在队列删掉并返回请求，调用者需持有mu
+}
+
+// 调用者需持有mu。在u放进队列之前调用，按Done登记到索引里（取消时据此直接找到它），
+// 返回的entry在放进队列之后设置remove
+func enqueueEntry(u *SchedulingUnit, mu sync.Locker) *queueEntry {
+	u.entry = &queueEntry{mu: mu}
+	indexQueued(u.Done, u.entry)
+	return u.entry
+}
+
+// 调用者需持有所在队列的锁。把u标记为已取走，返回false说明已经被别的一方取走了
+func (u SchedulingUnit) take() bool {
+	if u.entry == nil {
+		return true
+	}
+	if u.entry.removed {
+		return false
+	}
+	u.entry.removed = true
+	unindexQueued(u.Done, u.entry)
+	return true
+}
+
+// 是否让进行中的sequence优先调度
+var SeqAwareScheduling = true
+
+func newSchedulingUnit(h http.Handler, w http.ResponseWriter, r *http.Request, done *Completion) SchedulingUnit {
+	rate, _ := strconv.Atoi(r.Header.Get("X-Rate"))
+	u := SchedulingUnit{Handler: h, Writer: w, Req: r, Done: done, Work: ExpectedExecTime(rate), Revision: RevisionFrom(r.Context())}
+	if seqID := r.Header.Get("X-Seq-ID"); seqID != "" {
+		u.SeqID = seqID
+		u.SeqStep, _ = strconv.Atoi(r.Header.Get("X-Seq-Step"))
+		u.SeqRemaining, _ = strconv.ParseFloat(r.Header.Get("X-Seq-Remaining"), 64)
+	}
+	u.Deadline = parseDeadline(r)
+	return u
+}
+
+// X-Deadline请求头中的截止时间，没有的话返回零值
+func parseDeadline(r *http.Request) time.Time {
+	if deadline, err := strconv.ParseFloat(r.Header.Get("X-Deadline"), 64); err == nil && deadline > 0 {
+		return time.UnixMicro(int64(deadline * 1000))
+	}
+	return time.Time{}
+}
+
+// 已经开始执行的sequence（SeqStep>0）
+func (u SchedulingUnit) inProgressSeq() bool {
+	return SeqAwareScheduling && u.SeqID != "" && u.SeqStep > 0
+}
+
+// 入队：进行中的sequence排在所有新请求前面，彼此之间按剩余时间从短到长；其余请求照旧放队尾。调用者需持有QueueMutex
+func pushUnit(u SchedulingUnit) {
+	entry := enqueueEntry(&u, &QueueMutex)
+	e := insertUnit(u)
+	entry.remove = func() SchedulingUnit {
+		Queue.Remove(e)
+		return u
+	}
+}
+
+func insertUnit(u SchedulingUnit) *list.Element {
+	if !u.inProgressSeq() {
+		return Queue.PushBack(u)
+	}
+	for e := Queue.Front(); e != nil; e = e.Next() {
+		v := e.Value.(SchedulingUnit)
+		if !v.inProgressSeq() || v.SeqRemaining > u.SeqRemaining {
+			return Queue.InsertBefore(u, e)
+		}
+	}
+	return Queue.PushBack(u)
 }
 
 // 用于存储请求的线程安全队列
@@ -32,34 +124,109 @@ func init() {
 
 const MaxQueueize = 40000 // 定义队列的最大容量
 
+// 队列模式：入队函数和对应的出队goroutine必须配套使用，由main.go根据环境变量QUEUE_MODE选择
+type queueMode struct {
+	add    func(h http.Handler, w http.ResponseWriter, r *http.Request, done *Completion)
+	manage func()
+}
+
+var queueModes = map[string]queueMode{
+	"early": {AddReq0, ManageQueueEarly},   // 早期绑定
+	"late":  {AddReq0, ManageQueueLate},    // 延迟绑定
+	"exp1":  {AddReq12, ManageQueue1},      // 实验1
+	"exp2":  {AddReq12, ManageQueue},       // 实验2
+	"exp34": {AddReq, ManageQueue},         // 实验3，4
+	"edf":   {AddReqEDF, ManageQueueEDF},   // 最早截止时间优先
+	"fair":  {AddReqFair, ManageQueueFair}, // 租户间加权公平队列
+	"mlfq":  {AddReqMLFQ, ManageQueueMLFQ}, // 多级反馈队列
+}
+
+var curQueueMode = queueModes["exp34"]
+
+// 不认识的模式名返回false，保持默认的实验3，4
+func SetQueueMode(mode string) bool {
+	m, ok := queueModes[mode]
+	if ok {
+		curQueueMode = m
+	}
+	return ok
+}
+
+// 按当前队列模式入队，入队前先过准入控制；正在退出的activator不再接收请求
+func EnqueueReq(h http.Handler, w http.ResponseWriter, r *http.Request, done *Completion) {
+	if IsDraining() {
+		rejectDraining(w)
+		done.Finish(OutcomeRejected)
+		return
+	}
+	if !Admit(w, r) {
+		done.Finish(OutcomeRejected)
+		return
+	}
+	rate, _ := strconv.Atoi(r.Header.Get("X-Rate"))
+	addQueuedWork(RevisionFrom(r.Context()), ExpectedExecTime(rate))
+	walQueueEvent("Q", done, strconv.Itoa(rate))
+	watchCancel(r.Context(), done)
+	curQueueMode.add(h, w, r, done)
+}
+
+// 队列满了，直接完成让HandlerFunc返回
+func queueFull(u SchedulingUnit) {
+	fmt.Println("队列已满")
+	stopWatchCancel(u.Done)
+	addQueuedWork(u.Revision, -u.Work)
+	u.Done.Finish(OutcomeQueueFull)
+}
+
+// 按当前队列模式处理队列，main.go中用go调用
+func RunQueue() {
+	curQueueMode.manage()
+}
+
 // 延迟绑定需要在上下文中放一个通道，以便调度完成后关闭之，再取下一个任务。这样队列长度会累积得很多，可以说明控制节点内存瓶颈问题
 type ContextKey string
 
 const SchedulingDoneKey ContextKey = "schedulingDone"
 
+// 请求所属sequence的ID，供lbPolicy把同一条链的后续action放到同一个pod上
+const SeqIDKey ContextKey = "seqID"
+
+// 给请求的上下文放一个schedulingDone信号，pod选定后由handler触发
+func withSchedulingDone(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), SchedulingDoneKey, NewSignal())
+	return r.WithContext(ctx)
+}
+
+// 等待u被调度到pod上（或者超过20秒）
+func waitScheduled(u SchedulingUnit) {
+	timer := time.NewTimer(20 * time.Second)
+	defer timer.Stop()
+	select {
+	case <-u.Req.Context().Value(SchedulingDoneKey).(*Signal).C():
+	case <-timer.C:
+	}
+}
+
 // var vary = 40.0 // Azure
 var vary = 200.0 // zipf
 // var vary = 160.0 // powerlaw
 
-func AddReq0(h http.Handler, w http.ResponseWriter, r *http.Request, done chan struct{}) { // 早期绑定和延迟绑定：直接加入队列
-	schedulingDone := make(chan struct{})
-	ctx := context.WithValue(r.Context(), SchedulingDoneKey, schedulingDone)
-	u := SchedulingUnit{Handler: h, Writer: w, Req: r.WithContext(ctx), Done: done}
+func AddReq0(h http.Handler, w http.ResponseWriter, r *http.Request, done *Completion) { // 早期绑定和延迟绑定：直接加入队列
+	u := newSchedulingUnit(h, w, withSchedulingDone(r), done)
 
 	QueueMutex.Lock()
 	defer QueueMutex.Unlock()
 	len := Queue.Len()
 
 	if len >= MaxQueueize {
-		fmt.Println("队列已满")
-		close(done)
+		queueFull(u)
 		return
 	}
 
 	if len > MaxQueueActualLen {
 		MaxQueueActualLen = len
 	}
-	Queue.PushBack(u)
+	pushUnit(u)
 	QueueCond.Signal()
 }
 func ManageQueueEarly() { // 早期绑定：不断取队头元素然后serve
@@ -70,6 +237,7 @@ func ManageQueueEarly() { // 早期绑定：不断取队头元素然后serve
 		}
 		e := Queue.Front()
 		u := e.Value.(SchedulingUnit)
+		u.take()
 		Queue.Remove(e)
 		QueueMutex.Unlock()
 
@@ -84,31 +252,28 @@ func ManageQueueLate() { // 延迟绑定：取队头元素，等schedulingDone
 		}
 		e := Queue.Front()
 		u := e.Value.(SchedulingUnit)
+		u.take()
 		Queue.Remove(e)
 		QueueMutex.Unlock()
 
 		go serveRequest(u)
 
 		// 等待调度完成，立即处理下一个请求
-		select {
-		case <-u.Req.Context().Value(SchedulingDoneKey).(chan struct{}):
-		case <-time.After(20 * time.Second):
-		}
+		waitScheduled(u)
 	}
 
 }
 
-func AddReq12(h http.Handler, w http.ResponseWriter, r *http.Request, done chan struct{}) { // 实验1，2：简单抢占
+func AddReq12(h http.Handler, w http.ResponseWriter, r *http.Request, done *Completion) { // 实验1，2：简单抢占
 	rate, _ := strconv.Atoi(r.Header.Get("X-Rate"))
-	u := SchedulingUnit{Handler: h, Writer: w, Req: r, Done: done}
+	u := newSchedulingUnit(h, w, r, done)
 	u.Timer = time.NewTimer(time.Duration(MaxWaitingTime) * time.Millisecond)
 
 	QueueMutex.Lock()
 	defer QueueMutex.Unlock()
 
 	if Queue.Len() >= MaxQueueize {
-		fmt.Println("队列已满")
-		close(done)
+		queueFull(u)
 		return
 	}
 
@@ -124,7 +289,7 @@ func AddReq12(h http.Handler, w http.ResponseWriter, r *http.Request, done chan
 		}
 	}
 
-	Queue.PushBack(u)
+	pushUnit(u)
 	QueueCond.Signal() // 让ManageQueue中该队列对应的goroutine解除阻塞
 }
 
@@ -136,6 +301,7 @@ func ManageQueue1() { // 实验1，不轮询等待，每次取队头元素并ser
 		}
 		e := Queue.Back()
 		u := e.Value.(SchedulingUnit)
+		u.take()
 		Queue.Remove(e)
 		QueueMutex.Unlock()
 
@@ -144,9 +310,9 @@ func ManageQueue1() { // 实验1，不轮询等待，每次取队头元素并ser
 	}
 }
 
-func AddReq(h http.Handler, w http.ResponseWriter, r *http.Request, done chan struct{}) { // 实验3，4
+func AddReq(h http.Handler, w http.ResponseWriter, r *http.Request, done *Completion) { // 实验3，4
 	rate, _ := strconv.Atoi(r.Header.Get("X-Rate"))
-	u := SchedulingUnit{Handler: h, Writer: w, Req: r, Done: done}
+	u := newSchedulingUnit(h, w, r, done)
 
 	QueueMutex.Lock()
 	defer QueueMutex.Unlock()
@@ -157,8 +323,7 @@ func AddReq(h http.Handler, w http.ResponseWriter, r *http.Request, done chan st
 	}
 
 	if len >= MaxQueueize {
-		fmt.Println("队列已满")
-		close(done)
+		queueFull(u)
 		return
 	}
 
@@ -170,7 +335,8 @@ func AddReq(h http.Handler, w http.ResponseWriter, r *http.Request, done chan st
 	D := float64(rate) - float64(JoblenEdge[1]) + 750 // 100Azure, 750zipf, ??powerlaw
 
 	// if float64(Lambda)*D < 1000 { // rate/avgExecTime < 0.7
-	if groupIndex <= 1 || float64(Lambda)*D < 1000 {
+	// 进行中的sequence也直接执行，免得链的后续action排在无关的短任务后面
+	if groupIndex <= 1 || float64(Lambda)*D < 1000 || u.inProgressSeq() {
 		// preemptJobNum++
 		// fmt.Println("D=", D)
 		u.Req.Header.Set("X-Last-Rate", "1")
@@ -181,7 +347,7 @@ func AddReq(h http.Handler, w http.ResponseWriter, r *http.Request, done chan st
 	waitingTime := min(vary*math.Log(float64(Lambda)*D/1000)/D*JoblenMap[groupIndex], 4000)
 	fmt.Println("等待时间为", waitingTime)
 	u.Timer = time.NewTimer(time.Duration(waitingTime) * time.Millisecond)
-	Queue.PushBack(u)
+	pushUnit(u) // 进行中的sequence上面已经直接发出了，这里就是放队尾
 	QueueCond.Signal() // 让ManageQueue中该队列对应的goroutine解除阻塞
 }
 
@@ -198,9 +364,15 @@ func ManageQueue() { // 实验2，3，4(包括一阶段和二阶段)
 		for e != nil {
 			QueueMutex.Lock()
 			u := e.Value.(SchedulingUnit)
+			if u.entry.removed {
+				// 放开锁的时候被取消或者退出流程删掉了，它的Prev()也不再可信，从队尾重新开始
+				QueueMutex.Unlock()
+				break
+			}
 			prev := e.Prev()
 			select {
 			case <-u.Timer.C:
+				u.take()
 				Queue.Remove(e)
 				go serveRequest(u)
 			default:
@@ -212,17 +384,26 @@ func ManageQueue() { // 实验2，3，4(包括一阶段和二阶段)
 }
 
 func serveRequest(u SchedulingUnit) {
-	timer := time.NewTimer(time.Duration(300) * time.Second)
-	u.Handler.ServeHTTP(u.Writer, u.Req)
-	select {
-	case <-timer.C:
-		// TimeoutJobNumMutex.Lock()
-		// TimeoutJobNum += 1
-		// fmt.Println("超时任务数量为", TimeoutJobNum)
-		// TimeoutJobNumMutex.Unlock()
-		// 让HandlerFunc超时处理程序来关闭通道，避免重复关闭
-	default:
-		close(u.Done)
+	// revision还在从零扩容的话先缓冲，见coldstart.go
+	if holdForCapacity(u) {
+		return
+	}
+	dispatchUnit(u)
+}
 
+// u必须是用take()从队列里取到的（或者从没排过队），取消和退出流程取走的请求已经完成了，不会再走到这里
+func dispatchUnit(u SchedulingUnit) {
+	addQueuedWork(u.Revision, -u.Work) // 出队了，从排队的工作量变成在途的工作量
+	stopWatchCancel(u.Done)
+	// 客户端已经断开或者超过截止时间了，不再发给pod。等待调度完成的队列还在等schedulingDone，替handler触发
+	if err := u.Req.Context().Err(); err != nil {
+		countCancelled()
+		MarkScheduled(u.Req.Context())
+		u.Done.Finish(outcomeOf(err))
+		return
 	}
+	// 代理受请求上下文的截止时间约束，超时了会自己中断，这里不用再单独计时
+	walQueueEvent("S", u.Done)
+	u.Handler.ServeHTTP(u.Writer, u.Req)
+	u.Done.Finish(OutcomeServed)
 }
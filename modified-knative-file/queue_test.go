@@ -0,0 +1,221 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestUnit(t *testing.T, rate string) SchedulingUnit {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Rate", rate)
+	done := NewCompletion(httptest.NewRecorder())
+	u := newSchedulingUnit(http.NotFoundHandler(), done.Writer(), r, done)
+	u.Timer = time.NewTimer(time.Hour)
+	return u
+}
+
+// ManageQueue放开锁时拿着的元素被退出流程取走之后，重新加锁时要能看出来，不能再发一次
+func TestTakeAllQueuedMarksHeldElement(t *testing.T) {
+	t.Cleanup(func() { Queue.Init() })
+	QueueMutex.Lock()
+	for _, rate := range []string{"1", "2", "3"} {
+		pushUnit(newTestUnit(t, rate))
+	}
+	held := Queue.Back()
+	QueueMutex.Unlock()
+
+	units := takeAllQueued()
+	if len(units) != 3 {
+		t.Fatalf("takeAllQueued() returned %d units, want 3", len(units))
+	}
+	QueueMutex.Lock()
+	defer QueueMutex.Unlock()
+	if Queue.Len() != 0 {
+		t.Errorf("Queue.Len() = %d after takeAllQueued, want 0", Queue.Len())
+	}
+	if u := held.Value.(SchedulingUnit); !u.entry.removed || u.take() {
+		t.Error("held element is not marked removed, ManageQueue would dispatch it again")
+	}
+}
+
+// 取消删掉的元素同样要标记，而且排队的工作量只扣一次
+func TestCancelQueuedMarksHeldElement(t *testing.T) {
+	t.Cleanup(func() { Queue.Init() })
+	u := newTestUnit(t, "100")
+	addQueuedWork(u.Revision, u.Work)
+	QueueMutex.Lock()
+	pushUnit(u)
+	held := Queue.Back()
+	QueueMutex.Unlock()
+
+	cancelQueued(u.Done, context.Canceled)
+	if got := u.Done.Outcome(); got != OutcomeCancelled {
+		t.Errorf("Outcome() = %v, want %v", got, OutcomeCancelled)
+	}
+	QueueMutex.Lock()
+	removed := held.Value.(SchedulingUnit).entry.removed
+	QueueMutex.Unlock()
+	if !removed {
+		t.Error("cancelled element is not marked removed")
+	}
+	// 再取消一次（比如AfterFunc和退出流程撞在一起）什么也不做
+	cancelQueued(u.Done, context.Canceled)
+	if got := QueuedWork(u.Revision); got != 0 {
+		t.Errorf("QueuedWork() = %v after cancel, want 0", got)
+	}
+}
+
+// 每种队列（和冷启动缓冲区）里的请求都能按Done直接找到并取消，取消之后索引里不再有它
+func TestCancelQueuedFromEveryQueue(t *testing.T) {
+	tests := []struct {
+		name  string
+		add   func(u SchedulingUnit)
+		count func() int
+	}{{
+		name: "fifo",
+		add: func(u SchedulingUnit) {
+			QueueMutex.Lock()
+			defer QueueMutex.Unlock()
+			pushUnit(u)
+		},
+		count: func() int {
+			QueueMutex.Lock()
+			defer QueueMutex.Unlock()
+			return Queue.Len()
+		},
+	}, {
+		name: "edf",
+		add:  func(u SchedulingUnit) { AddReqEDF(u.Handler, u.Writer, u.Req, u.Done) },
+		count: func() int {
+			EDFQueueMutex.Lock()
+			defer EDFQueueMutex.Unlock()
+			return EDFQueue.Len()
+		},
+	}, {
+		name: "fair",
+		add:  func(u SchedulingUnit) { AddReqFair(u.Handler, u.Writer, u.Req, u.Done) },
+		count: func() int {
+			FairQueueMutex.Lock()
+			defer FairQueueMutex.Unlock()
+			return fairQueuedNum + len(fairTenants) + fairActive.Len()
+		},
+	}, {
+		name: "mlfq",
+		add:  func(u SchedulingUnit) { AddReqMLFQ(u.Handler, u.Writer, u.Req, u.Done) },
+		count: func() int {
+			MLFQQueueMutex.Lock()
+			defer MLFQQueueMutex.Unlock()
+			return mlfqQueuedNum
+		},
+	}, {
+		name: "cold",
+		add: func(u SchedulingUnit) {
+			SetReadyBackends(u.Revision, 0)
+			holdForCapacity(u)
+		},
+		count: ColdBufferedNum,
+	}}
+	t.Cleanup(func() {
+		coldMutex.Lock()
+		coldStates = make(map[string]*coldRevision)
+		coldMutex.Unlock()
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second := newTestUnit(t, "100"), newTestUnit(t, "200")
+			for _, u := range []SchedulingUnit{first, second} {
+				addQueuedWork(u.Revision, u.Work) // EnqueueReq里做的
+				tt.add(u)
+			}
+
+			cancelQueued(first.Done, context.DeadlineExceeded)
+			if got := first.Done.Outcome(); got != OutcomeTimedOut {
+				t.Errorf("Outcome() = %v, want %v", got, OutcomeTimedOut)
+			}
+			if lookupQueued(first.Done) != nil {
+				t.Error("cancelled unit is still indexed")
+			}
+			if lookupQueued(second.Done) == nil {
+				t.Error("the other unit was dropped from the index")
+			}
+
+			cancelQueued(second.Done, context.Canceled)
+			if got := second.Done.Outcome(); got != OutcomeCancelled {
+				t.Errorf("Outcome() = %v, want %v", got, OutcomeCancelled)
+			}
+			if got := tt.count(); got != 0 {
+				t.Errorf("queue still holds %d after cancelling everything", got)
+			}
+			if got := QueuedWork(""); got != 0 {
+				t.Errorf("QueuedWork() = %v after cancelling everything, want 0", got)
+			}
+		})
+	}
+}
+
+// 一个revision从零扩容时只缓冲它自己的请求，就绪之后按它自己的pod数放出
+func TestColdBufferPerRevision(t *testing.T) {
+	t.Cleanup(func() {
+		coldMutex.Lock()
+		coldStates = make(map[string]*coldRevision)
+		coldMutex.Unlock()
+	})
+	SetReadyBackends("default/cold", 0)
+	SetReadyBackends("default/warm", 2)
+
+	cold, warm := newTestUnit(t, "100"), newTestUnit(t, "100")
+	cold.Revision, warm.Revision = "default/cold", "default/warm"
+	addQueuedWork(cold.Revision, cold.Work) // EnqueueReq里做的
+	if !holdForCapacity(cold) {
+		t.Fatal("request of a revision with no ready pods was not buffered")
+	}
+	if holdForCapacity(warm) {
+		t.Fatal("request of a steady revision was buffered")
+	}
+	if got := GetCapacityState("default/warm"); got != CapacitySteady {
+		t.Errorf("warm revision state = %v, want steady", got)
+	}
+
+	SetReadyBackends("default/cold", 1)
+	if got := GetCapacityState("default/cold"); got != CapacityGrowing {
+		t.Errorf("cold revision state = %v, want growing", got)
+	}
+	// 放出的请求调用NotFoundHandler，Completion结束后不再算在缓冲区里
+	eventually(t, func() bool { return ColdBufferedNum() == 0 })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if outcome, _ := waitLikeHandler(ctx, cold.Done); outcome != OutcomeServed {
+		t.Fatalf("released request outcome = %v, want served", outcome)
+	}
+
+	if got := QueuedWork("default/cold"); got != 0 {
+		t.Errorf("QueuedWork after release = %v, want 0", got)
+	}
+
+	ForgetRevision("default/cold")
+	if got := GetCapacityState("default/cold"); got != CapacitySteady {
+		t.Errorf("deleted revision state = %v, want steady", got)
+	}
+}
+
+// 队列满了的请求直接以queue_full结束，不会留下排队的工作量
+func TestEnqueueQueueFull(t *testing.T) {
+	t.Cleanup(ResetState)
+	FillQueue(MaxQueueize)
+	// rate 30属于第3组，要进队列
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Rate", "30")
+	r = r.WithContext(context.WithValue(r.Context(), RevisionKey, "default/alu-bench-00001"))
+	done := NewCompletion(httptest.NewRecorder())
+	EnqueueReq(http.NotFoundHandler(), done.Writer(), r, done)
+	if got := done.Outcome(); got != OutcomeQueueFull {
+		t.Errorf("Outcome() = %v, want %v", got, OutcomeQueueFull)
+	}
+	if got := QueuedWork("default/alu-bench-00001"); got != 0 {
+		t.Errorf("QueuedWork = %v, want 0", got)
+	}
+}
@@ -44,8 +44,9 @@ func init() {
 	reader := csv.NewReader(chainCDFFile)
 	_, _ = reader.Read() // 跳过第一行
 	for {
-		record, _ := reader.Read()
-		if record == nil {
+		// 文件不存在（比如在集群外跑测试）或者读完了都直接跳过
+		record, err := reader.Read()
+		if err != nil || len(record) < 2 {
 			break
 		}
 		lengthStr := record[0]
@@ -61,8 +62,8 @@ func init() {
 	invokesCDFFile, _ := os.Open("/app/CDFs/invokesCDF.csv")
 	reader = csv.NewReader(invokesCDFFile)
 	for {
-		record, _ := reader.Read()
-		if record == nil {
+		record, err := reader.Read()
+		if err != nil || len(record) < 2 {
 			break
 		}
 		invokeTimeStr := record[0]
@@ -78,8 +79,8 @@ func init() {
 	CVsCDFFile, _ := os.Open("/app/CDFs/CVs.csv")
 	reader = csv.NewReader(CVsCDFFile)
 	for {
-		record, _ := reader.Read()
-		if record == nil {
+		record, err := reader.Read()
+		if err != nil || len(record) < 2 {
 			break
 		}
 		cvStr := record[0]
@@ -95,8 +96,8 @@ func init() {
 	execTimeCDFFile, _ := os.Open("/app/CDFs/execTimeCDF.csv")
 	reader = csv.NewReader(execTimeCDFFile)
 	for {
-		record, _ := reader.Read()
-		if record == nil {
+		record, err := reader.Read()
+		if err != nil || len(record) < 2 {
 			break
 		}
 		exectimeStr := record[0]
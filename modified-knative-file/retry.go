@@ -0,0 +1,72 @@
+// 发往pod失败时重试：pod刚被缩掉时反向代理会遇到连接错误或者queue-proxy返回的502，原来直接把错误返回给客户端，
+// requestStatic里还一直算着这个任务。现在对GET请求（alu.py和real-world都是GET，可以安全重发）回滚AddReqToRS，
+// 把这个pod标记为可疑，由revisionThrottler.try排除它重新选一个pod，最多重试MaxPodRetries次
+
+package shared
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// proxyRequest发往pod失败、可以换一个pod重试时返回的错误
+var ErrPodFailed = errors.New("request to pod failed")
+
+// 最多重试几次，0表示不重试，由main.go根据环境变量POD_RETRIES设置
+var MaxPodRetries = 0
+
+// 失败过的pod在这段时间内不再被选中（除非没有别的pod了）
+var PodSuspectCooldown = 10 * time.Second
+
+var (
+	suspectMutex sync.RWMutex
+	suspectUntil = make(map[string]time.Time) // pod的ip -> 可疑状态的结束时间
+
+	RetriedJobNum = 0 // 换pod重试的次数
+)
+
+func MarkPodSuspect(podip string) {
+	suspectMutex.Lock()
+	defer suspectMutex.Unlock()
+	suspectUntil[podip] = time.Now().Add(PodSuspectCooldown)
+}
+
+func IsPodSuspect(podip string) bool {
+	suspectMutex.RLock()
+	until, ok := suspectUntil[podip]
+	suspectMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		suspectMutex.Lock()
+		delete(suspectUntil, podip)
+		suspectMutex.Unlock()
+		return false
+	}
+	return true
+}
+
+// 请求发往podip失败：撤销发出时记下的占用和MLFQ的发出记录，并把pod标记为可疑
+func RollbackDispatch(podip string, rate int, dispatchID string) {
+	UndoDispatch(podip, rate, dispatchID)
+	MarkPodSuspect(podip)
+}
+
+// 请求没有到达pod就被取消了（比如对冲输掉的那份）：pod不会回调/store，撤销发出时记下的占用和MLFQ的发出记录，
+// 不是pod的问题，不标记可疑
+func UndoDispatch(podip string, rate int, dispatchID string) {
+	DelReqFromRS(podip, rate)
+	ForgetDispatch(dispatchID)
+	if WorkStealing {
+		ReleasePodSlot(podip)
+	}
+}
+
+// revisionThrottler.try重试前调用
+func CountRetry() {
+	GlobalVarMutex.Lock()
+	defer GlobalVarMutex.Unlock()
+	RetriedJobNum++
+}
@@ -0,0 +1,222 @@
+// 用真正的Throttler和handler链跑的确定性场景：请求走WrapActivatorHandlerWithFullDuplex、自定义队列、
+// activationHandler和Throttler.Try，pod用fakepod，pod的增减经过假的revisionDestsUpdate通道交给run循环。
+// 每个场景用自己的revision和pod ip，按revision检查状态，场景之间不用清全局状态
+
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	activatortest "knative.dev/serving/pkg/activator/testing"
+	"knative.dev/serving/pkg/fakepod"
+	"knative.dev/serving/pkg/shared"
+)
+
+// 场景的运行环境：一个revision，一个HarnessThrottler，一条handler链，pod挂在假的pod网络上
+type scenarioEnv struct {
+	t         *testing.T
+	revID     types.NamespacedName
+	throttler *HarnessThrottler
+	harness   *activatortest.Harness
+	pods      *activatortest.PodNetwork
+	callbacks *httptest.Server
+	started   chan string // pod回调/start带回的X-Dispatch-ID
+
+	mu    sync.Mutex
+	dests map[string]string // pod的ip -> dest
+}
+
+// cc是revision的containerConcurrency，0表示不限。revision名里要有real-world，请求按trace回放的单个action走
+func newScenarioEnv(t *testing.T, name string, cc int64) *scenarioEnv {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	rev := NewHarnessRevision("default", name, cc, nil)
+	env := &scenarioEnv{
+		t:         t,
+		revID:     types.NamespacedName{Namespace: rev.Namespace, Name: rev.Name},
+		throttler: NewHarnessThrottler(ctx, "10.1.0.1"),
+		pods:      activatortest.NewPodNetwork(),
+		started:   make(chan string, 16),
+		dests:     make(map[string]string),
+	}
+	if err := env.throttler.AddRevision(rev); err != nil {
+		t.Fatal(err)
+	}
+	env.harness = activatortest.NewHarness(ctx, env.throttler, env.pods.Transport(), rev)
+	env.callbacks = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.harness.Callbacks.ServeHTTP(w, r)
+		if r.URL.Path == "/start" {
+			env.started <- r.URL.Query().Get("id")
+		}
+	}))
+	// 先停pod再停回调：pod被断开之后还会回调/store
+	t.Cleanup(env.callbacks.Close)
+	t.Cleanup(env.pods.Close)
+	return env
+}
+
+// 加一个pod，lostCallbacks为true时pod不回调/store
+func (env *scenarioEnv) addPod(ip string, scale float64, lostCallbacks bool) *fakepod.Server {
+	cfg := fakepod.Config{Mode: fakepod.ModeRealWorld, PodIP: ip, Scale: scale, StartURL: env.callbacks.URL + "/start"}
+	if !lostCallbacks {
+		cfg.StoreURL = env.callbacks.URL + "/store"
+	}
+	pod := fakepod.New(cfg)
+	env.addHandler(ip, pod)
+	return pod
+}
+
+// 加一个行为由调用者决定的pod，比如总是失败的pod
+func (env *scenarioEnv) addHandler(ip string, pod http.Handler) {
+	env.mu.Lock()
+	env.dests[ip] = env.pods.Add(ip, pod)
+	env.mu.Unlock()
+	env.updateDests()
+}
+
+// 去掉一个pod：先从revision的pod里拿掉，再断开还在它上面跑的请求
+func (env *scenarioEnv) removePod(ip string) {
+	env.mu.Lock()
+	delete(env.dests, ip)
+	env.mu.Unlock()
+	env.updateDests()
+	env.pods.Remove(ip)
+}
+
+func (env *scenarioEnv) updateDests() {
+	env.mu.Lock()
+	dests := make([]string, 0, len(env.dests))
+	for _, dest := range env.dests {
+		dests = append(dests, dest)
+	}
+	env.mu.Unlock()
+	env.throttler.UpdateDests(env.revID, dests...)
+}
+
+func (env *scenarioEnv) rev() string {
+	return env.revID.String()
+}
+
+// 发一个执行时间为rate毫秒的请求，slo不为0时带上X-SLO，返回这个action的结果。
+// 可以在别的goroutine里调用，出错时只记Errorf
+func (env *scenarioEnv) do(rate int, slo time.Duration) shared.StepResult {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Trace-Rate", strconv.Itoa(rate))
+	r.Header.Set("Accept", "application/json")
+	if slo > 0 {
+		r.Header.Set("X-SLO", strconv.FormatInt(slo.Milliseconds(), 10))
+	}
+	w := httptest.NewRecorder()
+	env.harness.Handler.ServeHTTP(w, r)
+	var res shared.WorkflowResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Steps) != 1 {
+		env.t.Errorf("response %d %q is not a single-step result: %v", w.Code, w.Body.String(), err)
+		return shared.StepResult{}
+	}
+	return res.Steps[0]
+}
+
+func served(sr shared.StepResult) bool {
+	return sr.Outcome == shared.OutcomeServed.String() && sr.Status == http.StatusOK
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not reached within 2s", what)
+		}
+	}
+}
+
+// 实验3，4的队列：rate 1到5属于最短的两组，不排队直接发出，不受等待时间的随机性影响。
+// 队列满的场景不经过pod，在shared的TestEnqueueQueueFull里
+func TestScenarios(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, env *scenarioEnv)
+	}{{
+		name: "pods added and removed between requests",
+		run: func(t *testing.T, env *scenarioEnv) {
+			first := env.addPod("10.0.1.1", 1, false)
+			if sr := env.do(5, 0); !served(sr) {
+				t.Fatalf("first request: %+v", sr)
+			}
+			second := env.addPod("10.0.1.2", 1, false)
+			env.removePod("10.0.1.1")
+			if sr := env.do(5, 0); !served(sr) {
+				t.Fatalf("request after scaling: %+v", sr)
+			}
+			if first.Served() != 1 || second.Served() != 1 {
+				t.Errorf("served = %d, %d, want 1, 1", first.Served(), second.Served())
+			}
+			if got := shared.GetPodNum(env.rev()); got != 1 {
+				t.Errorf("GetPodNum = %d, want 1", got)
+			}
+		},
+	}, {
+		name: "pod removed while serving",
+		run: func(t *testing.T, env *scenarioEnv) {
+			// 5毫秒放大100倍是0.5秒
+			env.addPod("10.0.2.1", 100, false)
+			result := make(chan shared.StepResult)
+			go func() { result <- env.do(5, 0) }()
+			<-env.started
+			env.removePod("10.0.2.1")
+			if sr := <-result; sr.Status != http.StatusBadGateway {
+				t.Errorf("status = %d, want 502", sr.Status)
+			}
+			// 连接断了不会再有回调，占用由RollbackDispatch撤销，pod被标记为可疑
+			if got := shared.InflightJobNum(env.rev()); got != 0 {
+				t.Errorf("InflightJobNum = %d, want 0", got)
+			}
+			if !shared.IsPodSuspect("10.0.2.1") {
+				t.Error("failed pod is not suspect")
+			}
+		},
+	}, {
+		name: "timeout while the pod is running",
+		run: func(t *testing.T, env *scenarioEnv) {
+			env.addPod("10.0.3.1", 100, false)
+			if sr := env.do(5, 100*time.Millisecond); !sr.TimedOut || sr.Outcome != shared.OutcomeTimedOut.String() {
+				t.Errorf("got %+v, want timed_out", sr)
+			}
+			// 请求已经到了pod，pod停下之后照样回调/store，占用由回调撤销
+			eventually(t, "callback after timeout", func() bool { return shared.InflightJobNum(env.rev()) == 0 })
+		},
+	}, {
+		name: "lost callback reconciled by probing",
+		run: func(t *testing.T, env *scenarioEnv) {
+			env.addPod("10.0.4.1", 1, true)
+			if sr := env.do(5, 0); !served(sr) {
+				t.Fatalf("got %+v, want served", sr)
+			}
+			if got := shared.InflightJobNum(env.rev()); got != 1 {
+				t.Fatalf("InflightJobNum without callback = %d, want 1", got)
+			}
+			// 探测到pod上实际没有任务，完全相信探测结果时对账删掉丢了回调的任务
+			old := shared.PodProbeTrust
+			shared.PodProbeTrust = 1
+			defer func() { shared.PodProbeTrust = old }()
+			shared.ReconcilePod("10.0.4.1", 0)
+			if got := shared.InflightJobNum(env.rev()); got != 0 {
+				t.Errorf("InflightJobNum after reconcile = %d, want 0", got)
+			}
+		},
+	}}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newScenarioEnv(t, fmt.Sprintf("real-world-%05d", i+1), 0))
+		})
+	}
+}
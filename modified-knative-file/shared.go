@@ -4,6 +4,8 @@
 package shared
 
 import (
+	"context"
+	"math"
 	"math/rand"
 	"strconv"
 	"sync"
@@ -59,6 +61,16 @@ type PodInfo struct {
 	reqs    [10]int // pod上每个长短组的任务的数量
 	ratesum int64
 	jobnum  int
+	work    float64 // 在途任务的预计执行时间之和（毫秒），逐个任务按ExpectedExecTime累加
+	speed   float64 // 估计的pod速度（预计执行时间/实际执行时间）的EWMA，0表示还没观测过，见speed.go
+
+	// 最近一个探测间隔内发给pod的任务的时间，见ReconcilePod
+	recent []time.Time
+
+	// 预热情况，见warmup.go
+	addedAt      time.Time // pod加入的时间，零值表示没有登记过
+	served       int       // 已经执行完的请求数
+	firstRunTime float64   // 第一个请求的执行时间（毫秒）
 }
 
 type RequestStatic struct {
@@ -95,6 +107,11 @@ func CalculateAvgAndMaxExecTime() (float64, float64) {
 
 // 当一个任务调度成功时，更新requestStatic：将该任务的rate加入到对应pod的rates中（RS指的是Request Static）
 func AddReqToRS(podip string, rate int) {
+	walPodEvent("A", podip, rate)
+	addReqToRS(podip, rate)
+}
+
+func addReqToRS(podip string, rate int) {
 	requestStatic.Lock()
 	defer requestStatic.Unlock()
 	if _, ok := requestStatic.Data[podip]; !ok {
@@ -115,11 +132,17 @@ func AddReqToRS(podip string, rate int) {
 	// fmt.Println("添加", groupAvgExecTime)
 	podInfo.ratesum += int64(rate)
 	podInfo.jobnum++
+	podInfo.work += ExpectedExecTime(rate)
+	if PodProbeInterval > 0 {
+		now := time.Now()
+		podInfo.recent = append(pruneRecent(podInfo.recent, now), now)
+	}
 	requestStatic.Data[podip] = podInfo
 }
 
 // 当一个任务执行完返回报文到activator时，更新requestStatic：减一次该pod上这个相应的请求数，以及ratesum
 func DelReqFromRS(podip string, rate int) {
+	walPodEvent("D", podip, rate)
 	requestStatic.Lock()
 	defer requestStatic.Unlock()
 	if _, ok := requestStatic.Data[podip]; !ok {
@@ -136,16 +159,219 @@ func DelReqFromRS(podip string, rate int) {
 		// fmt.Println("删除", groupAvgExecTime)
 		podInfo.ratesum -= int64(rate)
 		podInfo.jobnum--
+		podInfo.work = max(podInfo.work-ExpectedExecTime(rate), 0)
+		if podInfo.jobnum == 0 {
+			podInfo.work = 0
+		}
+	}
+	requestStatic.Data[podip] = podInfo
+}
+
+// revision的pod上在途任务的预计执行时间之和（毫秒），和排队中的任务一样按每个任务的ExpectedExecTime计算。rev为空时统计所有pod
+func InflightWork(rev string) float64 {
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
+	work := 0.0
+	for podip, podInfo := range requestStatic.Data {
+		if podInRevision(podip, rev) {
+			work += podInfo.work
+		}
+	}
+	return work
+}
+
+// revision的pod上在途任务的个数，rev为空时统计所有pod
+func InflightJobNum(rev string) int {
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
+	num := 0
+	for podip, podInfo := range requestStatic.Data {
+		if podInRevision(podip, rev) {
+			num += podInfo.jobnum
+		}
+	}
+	return num
+}
+
+// revision排队和在途任务的预计执行时间之和（秒）。每秒上报一次的话，相当于一秒内要跑完积压需要的pod数，
+// 用来代替请求并发数给autoscaler。rev为空时统计所有revision
+func WorkWeightedConcurrency(rev string) float64 {
+	return (QueuedWork(rev) + InflightWork(rev)) / 1000
+}
+
+// 调度相关的计数，供/stats接口输出
+func Stats() map[string]float64 {
+	GlobalVarMutex.RLock()
+	stats := map[string]float64{
+		"cancelled":  float64(CancelledJobNum),
+		"shed":       float64(ShedJobNum),
+		"deferred":   float64(DeferredJobNum),
+		"totalJobs":  float64(TotalJobNum),
+		"edfRejects": float64(EDFRejectedNum),
+		"stolen":     float64(StolenJobNum),
+		"hedged":     float64(HedgedJobNum),
+		"hedgeWins":  float64(HedgeWinJobNum),
+		"retried":    float64(RetriedJobNum),
+		"ejections":  float64(EjectionNum),
+		"preempted":  float64(PreemptedJobNum),
+	}
+	GlobalVarMutex.RUnlock()
+	stats["queuedWork"] = QueuedWork("")
+	stats["inflightWork"] = InflightWork("")
+	stats["inflightJobs"] = float64(InflightJobNum(""))
+	stats["ejectedPods"] = float64(EjectedPodNum())
+	stats["workConcurrency"] = WorkWeightedConcurrency("")
+	stats["coldBuffered"] = float64(ColdBufferedNum())
+	return stats
+}
+
+// 请求上下文中存放revision（namespace/name）的键，由handler放进去。pod数、积压量都按revision分开算，
+// 否则一个空闲的revision会把别的revision的积压摊薄
+const RevisionKey ContextKey = "revision"
+
+func RevisionFrom(ctx context.Context) string {
+	rev, _ := ctx.Value(RevisionKey).(string)
+	return rev
+}
+
+// 每个revision分配给本activator的pod数量，以及每个pod属于哪个revision，由throttler更新
+var (
+	podNumMutex sync.RWMutex
+	podNum      = make(map[string]int)    // revision -> pod数
+	podRevision = make(map[string]string) // pod的ip -> revision
+)
+
+// throttler在容量变化时调用
+func SetPodNum(rev string, n int) {
+	podNumMutex.Lock()
+	defer podNumMutex.Unlock()
+	podNum[rev] = n
+}
+
+// rev为空时返回所有revision的pod数之和
+func GetPodNum(rev string) int {
+	podNumMutex.RLock()
+	defer podNumMutex.RUnlock()
+	if rev != "" {
+		return podNum[rev]
+	}
+	total := 0
+	for _, n := range podNum {
+		total += n
+	}
+	return total
+}
+
+// throttler收到endpoint更新时调用，podips是revision当前所有pod的ip
+func SetRevisionPods(rev string, podips []string) {
+	podNumMutex.Lock()
+	defer podNumMutex.Unlock()
+	for ip, r := range podRevision {
+		if r == rev {
+			delete(podRevision, ip)
+		}
+	}
+	for _, ip := range podips {
+		podRevision[ip] = rev
+	}
+}
+
+// revision被删除时调用
+func ForgetRevision(rev string) {
+	forgetColdRevision(rev)
+	podNumMutex.Lock()
+	defer podNumMutex.Unlock()
+	delete(podNum, rev)
+	for ip, r := range podRevision {
+		if r == rev {
+			delete(podRevision, ip)
+		}
+	}
+}
+
+// pod所属的revision，还不知道的话返回空
+func PodRevision(podip string) string {
+	podNumMutex.RLock()
+	defer podNumMutex.RUnlock()
+	return podRevision[podip]
+}
+
+// rev为空时所有pod都算
+func podInRevision(podip string, rev string) bool {
+	if rev == "" {
+		return true
+	}
+	podNumMutex.RLock()
+	defer podNumMutex.RUnlock()
+	return podRevision[podip] == rev
+}
+
+// pod探测的间隔，0表示不探测；以及对账时对探测结果的信任程度（0只信回调，1只信探测）
+var (
+	PodProbeInterval time.Duration = 0
+	PodProbeTrust                  = 0.5
+)
+
+// 用探测到的实际并发数对账requestStatic：按信任程度混合探测值和回调维护的任务数，
+// 结果比记录的少，就认为多出来的任务的回调丢了，从最长的组开始删（超时的往往是长任务）。
+// queue-proxy报告的是一个统计窗口内的平均并发数，刚发出去的任务在里面只占一小部分甚至还没算进去，
+// 所以最近一个探测间隔内发出的任务不删
+func ReconcilePod(podip string, probed float64) {
+	// 删掉的任务在工作窃取里占的位置也要还回去，否则等待队列会一直卡住
+	if removed := reconcilePod(podip, probed); WorkStealing {
+		for i := 0; i < removed; i++ {
+			ReleasePodSlot(podip)
+		}
+	}
+}
+
+func reconcilePod(podip string, probed float64) int {
+	requestStatic.Lock()
+	defer requestStatic.Unlock()
+	podInfo, ok := requestStatic.Data[podip]
+	if !ok || podInfo.jobnum == 0 {
+		return 0
+	}
+	removed := 0
+	target := int(math.Round(PodProbeTrust*probed + (1-PodProbeTrust)*float64(podInfo.jobnum)))
+	podInfo.recent = pruneRecent(podInfo.recent, time.Now())
+	target = max(target, min(len(podInfo.recent), podInfo.jobnum))
+	for i := len(podInfo.reqs) - 1; i >= 0 && podInfo.jobnum > target; i-- {
+		for podInfo.reqs[i] > 0 && podInfo.jobnum > target {
+			// 不知道丢掉的任务具体的rate，按平均值扣
+			podInfo.ratesum -= podInfo.ratesum / int64(podInfo.jobnum)
+			podInfo.work -= podInfo.work / float64(podInfo.jobnum)
+			podInfo.reqs[i]--
+			podInfo.jobnum--
+			removed++
+		}
+	}
+	if podInfo.jobnum == 0 {
+		podInfo.ratesum = 0
+		podInfo.work = 0
 	}
 	requestStatic.Data[podip] = podInfo
+	return removed
+}
+
+// 去掉早于一个探测间隔的发出时间
+func pruneRecent(recent []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(recent) && now.Sub(recent[i]) > PodProbeInterval {
+		i++
+	}
+	return recent[i:]
 }
 
-// 选择两个pod，根据rate选择其中一个
+// 选择两个pod，根据rate选择其中一个。ratesum按pod速度折算，快的pod同样的积压更快跑完。
+// 下面几个比较函数都在请求路径上，和/store回调、探测对账等并发，读requestStatic要加锁
 func ChoosePodByRate(podip1 string, podip2 string) string {
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
 	podInfo1 := requestStatic.Data[podip1]
 	podInfo2 := requestStatic.Data[podip2]
 	// fmt.Println("两个pod上的总rate数分别为：", podInfo1.ratesum, podInfo2.ratesum)
-	if podInfo1.ratesum > podInfo2.ratesum {
+	if float64(podInfo1.ratesum)/podInfo1.speedOrDefault() > float64(podInfo2.ratesum)/podInfo2.speedOrDefault() {
 		return podip2
 	} else {
 		return podip1
@@ -153,10 +379,12 @@ func ChoosePodByRate(podip1 string, podip2 string) string {
 }
 
 func ChoosePodByNumOfJobs(podip1 string, podip2 string) string {
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
 	podInfo1 := requestStatic.Data[podip1]
 	podInfo2 := requestStatic.Data[podip2]
 
-	if podInfo1.jobnum > podInfo2.jobnum {
+	if float64(podInfo1.jobnum)/podInfo1.speedOrDefault() > float64(podInfo2.jobnum)/podInfo2.speedOrDefault() {
 		return podip2
 	} else {
 		return podip1
@@ -164,11 +392,15 @@ func ChoosePodByNumOfJobs(podip1 string, podip2 string) string {
 }
 
 func CheckPodBusy(podip string) bool { // 占用则返回true
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
 	podInfo := requestStatic.Data[podip]
 	return podInfo.ratesum != 0
 }
 
 func ChooseIdlePod(podip1 string, podip2 string) string {
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
 	podInfo1 := requestStatic.Data[podip1]
 	podInfo2 := requestStatic.Data[podip2]
 	if podInfo1.ratesum == 0 {
@@ -182,6 +414,31 @@ func ChooseIdlePod(podip1 string, podip2 string) string {
 	}
 }
 
+// 每个sequence上一个action被调度到的pod，用于把后续action放到同一个已经热起来的pod上
+var (
+	seqPodMutex sync.RWMutex
+	seqPod      = make(map[string]string)
+)
+
+func RecordSeqPod(seqID string, podip string) {
+	seqPodMutex.Lock()
+	defer seqPodMutex.Unlock()
+	seqPod[seqID] = podip
+}
+
+func GetSeqPod(seqID string) string {
+	seqPodMutex.RLock()
+	defer seqPodMutex.RUnlock()
+	return seqPod[seqID]
+}
+
+// sequence结束后删掉，免得map无限增长
+func ForgetSeq(seqID string) {
+	seqPodMutex.Lock()
+	defer seqPodMutex.Unlock()
+	delete(seqPod, seqID)
+}
+
 // 全局变量，记录上一次的rate和到达时间戳（字符串，默认为空）
 var (
 	lastRateMutex sync.RWMutex
@@ -0,0 +1,186 @@
+package shared
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInflightWorkByRevision(t *testing.T) {
+	t.Cleanup(func() {
+		requestStatic.Data = make(map[string]PodInfo)
+		podNum = make(map[string]int)
+		podRevision = make(map[string]string)
+	})
+	SetRevisionPods("default/alu-bench-00001", []string{"10.0.0.1"})
+	SetRevisionPods("default/real-world-00001", []string{"10.0.0.2"})
+	SetPodNum("default/alu-bench-00001", 1)
+	SetPodNum("default/real-world-00001", 1)
+
+	// ALU的8000按JoblenMapALU算32000毫秒，而不是所在组的数学期望
+	addReqToRS("10.0.0.1", 8000)
+	addReqToRS("10.0.0.2", 100)
+
+	if got := InflightWork("default/alu-bench-00001"); got != 32000 {
+		t.Errorf("alu InflightWork = %v, want 32000", got)
+	}
+	if got, want := InflightWork("default/real-world-00001"), ExpectedExecTime(100); got != want {
+		t.Errorf("real-world InflightWork = %v, want %v", got, want)
+	}
+	if got, want := InflightWork(""), 32000+ExpectedExecTime(100); got != want {
+		t.Errorf("total InflightWork = %v, want %v", got, want)
+	}
+	if got := InflightJobNum("default/real-world-00001"); got != 1 {
+		t.Errorf("real-world InflightJobNum = %d, want 1", got)
+	}
+	if got := GetPodNum(""); got != 2 {
+		t.Errorf("GetPodNum(\"\") = %d, want 2", got)
+	}
+
+	DelReqFromRS("10.0.0.1", 8000)
+	if got := InflightWork("default/alu-bench-00001"); got != 0 {
+		t.Errorf("alu InflightWork after DelReqFromRS = %v, want 0", got)
+	}
+}
+
+func TestCallbackRate(t *testing.T) {
+	SetRevisionPods("default/alu-bench-00001", []string{"10.0.0.1"})
+	SetRevisionPods("default/real-world-00001", []string{"10.0.0.2"})
+	t.Cleanup(func() {
+		ForgetRevision("default/alu-bench-00001")
+		ForgetRevision("default/real-world-00001")
+	})
+
+	tests := []struct {
+		name  string
+		podip string
+		body  string
+		want  int
+	}{
+		// ALU：rate resp jct lat last
+		{"alu", "10.0.0.1", "8000 12 45000 1700000040000 1", 8000},
+		// real-world：seqlat resp rate lat last
+		{"real-world", "10.0.0.2", "3000 5 250 1700000000300 0\n", 250},
+		{"unknown pod alu", "10.0.0.9", "4000 12 20000 1700000020000 1", 4000},
+		{"unknown pod real-world", "10.0.0.9", "3000 5 250 1700000000300 0", 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CallbackRate(tt.podip, strings.Split(tt.body, " "))
+			if err != nil || got != tt.want {
+				t.Errorf("CallbackRate = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+	if _, err := CallbackRate("10.0.0.1", []string{"x", "1", "2"}); err == nil {
+		t.Error("CallbackRate accepted a non-numeric rate")
+	}
+	// 250在real-world的pod上就是250毫秒，不能按ALU的JoblenMapALU算
+	if got := jobExecTime("10.0.0.1", 250); got != 1000 {
+		t.Errorf("alu jobExecTime(250) = %v, want 1000", got)
+	}
+	if got := jobExecTime("10.0.0.2", 250); got != 250 {
+		t.Errorf("real-world jobExecTime(250) = %v, want 250", got)
+	}
+}
+
+func TestEndpointsPodNodesPrune(t *testing.T) {
+	t.Cleanup(func() {
+		podNode = make(map[string]string)
+		endpointPods = make(map[string]map[string]bool)
+	})
+	SetEndpointsPodNodes("default/alu-bench-00001-private", map[string]string{"10.0.0.1": "node1", "10.0.0.2": "node2"})
+	SetEndpointsPodNodes("default/real-world-00001-private", map[string]string{"10.0.0.3": "node1"})
+
+	// 缩容：10.0.0.2不在Endpoints里了
+	SetEndpointsPodNodes("default/alu-bench-00001-private", map[string]string{"10.0.0.1": "node1"})
+	if node := PodNode("10.0.0.2"); node != "" {
+		t.Errorf("PodNode of removed pod = %q, want empty", node)
+	}
+	if node := PodNode("10.0.0.1"); node != "node1" {
+		t.Errorf("PodNode of remaining pod = %q, want node1", node)
+	}
+
+	// Endpoints被删除时只删它自己的pod
+	SetEndpointsPodNodes("default/alu-bench-00001-private", nil)
+	if node := PodNode("10.0.0.1"); node != "" {
+		t.Errorf("PodNode after endpoints deleted = %q, want empty", node)
+	}
+	if node := PodNode("10.0.0.3"); node != "node1" {
+		t.Errorf("PodNode of other revision = %q, want node1", node)
+	}
+	if len(endpointPods) != 1 {
+		t.Errorf("endpointPods has %d entries, want 1", len(endpointPods))
+	}
+}
+
+func TestReportPodLatencyGroupsByRate(t *testing.T) {
+	t.Cleanup(func() {
+		outlierMutex.Lock()
+		defer outlierMutex.Unlock()
+		outliers = make(map[string]*outlierState)
+		groupLatency, groupSamples = [10]float64{}, [10]int{}
+	})
+	// ALU的8000和AddReqToRS一样按rate分组，而不是按32000毫秒的执行时间落到分组之外
+	ReportPodLatency("10.0.0.1", 8000, 32000)
+	outlierMutex.Lock()
+	defer outlierMutex.Unlock()
+	if index := GetGroupIndex(8000); index == -1 || groupSamples[index] != 1 {
+		t.Errorf("group %d has %v samples, want 1", index, groupSamples)
+	}
+}
+
+// seqAffinityPolicy在每个请求上调用CheckPodBusy，random2调用ChoosePodByRate，和调度、/store回调同时发生，用-race跑
+func TestPodComparisonsConcurrentWithDispatch(t *testing.T) {
+	t.Cleanup(func() { requestStatic.Data = make(map[string]PodInfo) })
+	var wg sync.WaitGroup
+	for _, podip := range []string{"10.0.0.1", "10.0.0.2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				addReqToRS(podip, 5)
+				ObservePodSpeed(podip, 5, 20)
+				DelReqFromRS(podip, 5)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			CheckPodBusy("10.0.0.1")
+			ChooseIdlePod("10.0.0.1", "10.0.0.2")
+			ChoosePodByRate("10.0.0.1", "10.0.0.2")
+			ChoosePodByNumOfJobs("10.0.0.1", "10.0.0.2")
+		}
+	}()
+	wg.Wait()
+	if CheckPodBusy("10.0.0.1") || CheckPodBusy("10.0.0.2") {
+		t.Error("pod still busy after every job was deleted")
+	}
+}
+
+// 探测值是窗口平均，刚发出去的任务还没反映出来，对账不能把它们删掉；过了一个探测间隔之后照常删
+func TestReconcileSparesRecentDispatches(t *testing.T) {
+	oldInterval, oldTrust := PodProbeInterval, PodProbeTrust
+	t.Cleanup(func() {
+		PodProbeInterval, PodProbeTrust = oldInterval, oldTrust
+		requestStatic.Data = make(map[string]PodInfo)
+	})
+	PodProbeInterval, PodProbeTrust = time.Hour, 1
+
+	addReqToRS("10.0.0.1", 100)
+	ReconcilePod("10.0.0.1", 0)
+	if got := requestStatic.Data["10.0.0.1"].jobnum; got != 1 {
+		t.Fatalf("jobnum after reconciling a fresh dispatch = %d, want 1", got)
+	}
+
+	PodProbeInterval = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	ReconcilePod("10.0.0.1", 0)
+	if got := requestStatic.Data["10.0.0.1"].jobnum; got != 0 {
+		t.Errorf("jobnum after the probe window = %d, want 0", got)
+	}
+}
@@ -0,0 +1,158 @@
+// 异构pod：pod和Redis、其他pod挤在同一批节点上，同样的任务在不同pod上跑的时间并不一样。
+// 每次/store回调时用实际执行时间和任务自己的理论执行时间（见jobExecTime）之比更新pod速度的EWMA，
+// 速度为1表示和预计的一样快，2表示快一倍。ChoosePodByRate等比较和SITA分配都按速度折算
+
+package shared
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 请求上下文中存放X-Rate的键，供lbPolicy按任务大小选pod（SITA）
+const RateKey ContextKey = "rate"
+
+// 速度EWMA的平滑系数
+const podSpeedAlpha = 0.2
+
+// 估计出来的速度限制在这个范围内，免得一次异常的回调（比如pod刚冷启动）把速度估得离谱
+const (
+	minPodSpeed = 0.1
+	maxPodSpeed = 10
+)
+
+// 没有观测过的pod按1算
+func (p PodInfo) speedOrDefault() float64 {
+	if p.speed == 0 {
+		return 1
+	}
+	return p.speed
+}
+
+// /store收到回调时调用：runTime是pod上实际的执行时间（毫秒）
+func ObservePodSpeed(podip string, rate int, runTime float64) {
+	if runTime <= 0 {
+		return
+	}
+	speed := jobExecTime(podip, rate) / runTime
+	speed = min(max(speed, minPodSpeed), maxPodSpeed)
+
+	requestStatic.Lock()
+	defer requestStatic.Unlock()
+	podInfo, ok := requestStatic.Data[podip]
+	if !ok {
+		return
+	}
+	if podInfo.speed == 0 {
+		podInfo.speed = speed
+	} else {
+		podInfo.speed = podSpeedAlpha*speed + (1-podSpeedAlpha)*podInfo.speed
+	}
+	requestStatic.Data[podip] = podInfo
+}
+
+func PodSpeed(podip string) float64 {
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
+	return requestStatic.Data[podip].speedOrDefault()
+}
+
+// pod跑的是不是real-world服务，按pod所属的revision名字判断（和handler一样看有没有real-world），known为false表示还不知道pod属于哪个revision
+func realWorldPod(podip string) (realWorld bool, known bool) {
+	rev := PodRevision(podip)
+	return strings.Contains(rev, "real-world"), rev != ""
+}
+
+// 一个任务自己的理论执行时间（毫秒）：ALU按JoblenMapALU，real-world的rate本身就是执行时间。
+// 和ExpectedExecTime不同，real-world不取所在组的数学期望，用来和这个任务的实际执行时间比较；
+// 两种服务的rate取值有重叠，所以要看任务是在哪个pod上跑的
+func jobExecTime(podip string, rate int) float64 {
+	if realWorld, _ := realWorldPod(podip); !realWorld {
+		if t, ok := JoblenMapALU[rate]; ok {
+			return float64(t)
+		}
+	}
+	return float64(rate)
+}
+
+// 从/store回调的请求体里取出rate：ALU返回的是"rate resp jct lat last"，real-world返回的是"seqlat resp rate lat last"。
+// 按pod所属的revision区分，还不知道revision的pod看第1项是不是ALU的rate
+func CallbackRate(podip string, fields []string) (int, error) {
+	if len(fields) < 3 {
+		return 0, fmt.Errorf("callback has %d fields, want at least 3", len(fields))
+	}
+	index := 2
+	if realWorld, known := realWorldPod(podip); known {
+		if !realWorld {
+			index = 0
+		}
+	} else if rate, err := strconv.Atoi(fields[0]); err == nil {
+		if _, ok := JoblenMapALU[rate]; ok {
+			index = 0
+		}
+	}
+	rate, err := strconv.Atoi(strings.TrimSpace(fields[index]))
+	if err != nil {
+		return 0, fmt.Errorf("bad rate in callback field %d: %w", index, err)
+	}
+	return rate, nil
+}
+
+// 从/store回调的请求体里算出实际执行时间：两种服务返回的第2项都是响应时间（到达activator到开始执行），
+// 第4项都是总延迟（到达activator到执行结束），相减就是执行时间
+func RunTimeFromCallback(body string) float64 {
+	fields := strings.Fields(body)
+	if len(fields) < 4 {
+		return 0
+	}
+	resp, err1 := strconv.ParseFloat(fields[1], 64)
+	lat, err2 := strconv.ParseFloat(fields[3], 64)
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	return lat - resp
+}
+
+func RateFromContext(ctx context.Context) int {
+	ratestr, _ := ctx.Value(RateKey).(string)
+	rate, _ := strconv.Atoi(ratestr)
+	return rate
+}
+
+// 按速度折算的SITA（Size Interval Task Assignment）：把pod按速度从慢到快排开，
+// 每个pod分到的任务大小区间的宽度和它的速度成正比，越长的任务分给越快的pod
+func SITAPod(podips []string, rate int) string {
+	if len(podips) == 0 {
+		return ""
+	}
+	requestStatic.RLock()
+	speeds := make(map[string]float64, len(podips))
+	total := 0.0
+	for _, ip := range podips {
+		speeds[ip] = requestStatic.Data[ip].speedOrDefault()
+		total += speeds[ip]
+	}
+	requestStatic.RUnlock()
+
+	sorted := append([]string(nil), podips...)
+	sort.SliceStable(sorted, func(i, j int) bool { return speeds[sorted[i]] < speeds[sorted[j]] })
+
+	// 任务大小在所有分组中所处的位置，取组的中点
+	index := GetGroupIndex(int(ExpectedExecTime(rate)))
+	if index == -1 {
+		index = len(JoblenEdge) - 1
+	}
+	q := (float64(index) + 0.5) / float64(len(JoblenEdge))
+
+	cum := 0.0
+	for _, ip := range sorted {
+		cum += speeds[ip]
+		if cum/total >= q {
+			return ip
+		}
+	}
+	return sorted[len(sorted)-1]
+}
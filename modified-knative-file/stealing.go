@@ -0,0 +1,116 @@
+// 早期绑定的工作窃取：simpleRandomChoice2Policy、pureRoundRobinPolicy选好pod之后请求就立刻发过去了，
+// 即使别的pod已经空闲，它也只能在选中的pod上排在长任务后面。打开WorkStealing后，选好pod的请求先在activator里
+// 该pod的等待队列中排队，直到pod上正在执行的任务少于PodQueueCapacity才真正发出；pod回调/store说明空出了位置，
+// 这时它自己的等待队列空了的话，就从同一个revision里等待队列最长的pod那里偷一个还没发出去的请求过来
+
+package shared
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// 是否打开工作窃取，由main.go根据环境变量WORK_STEALING设置
+var WorkStealing = false
+
+// 每个pod同时执行的任务数，超过的在activator里排队
+var PodQueueCapacity = 1
+
+type podWaiter struct {
+	granted chan string // 分到的pod的ip
+	elem    *list.Element
+	podip   string // 当前排在哪个pod的等待队列里
+}
+
+type podSlotQueue struct {
+	group   string // revision，只在同一个revision的pod之间窃取
+	running int
+	waiting list.List
+}
+
+var (
+	podSlotMutex sync.Mutex
+	podSlots     = make(map[string]*podSlotQueue)
+
+	StolenJobNum = 0 // 被窃取到别的pod上的请求数
+)
+
+// 调用者需持有podSlotMutex
+func podSlotQueueLocked(group string, podip string) *podSlotQueue {
+	q, ok := podSlots[podip]
+	if !ok {
+		q = &podSlotQueue{group: group}
+		podSlots[podip] = q
+	}
+	return q
+}
+
+// 等到podip有空位，返回最终发往的pod（可能被别的pod偷走了）。ctx结束时返回错误，请求不再发出
+func AcquirePodSlot(ctx context.Context, group string, podip string) (string, error) {
+	podSlotMutex.Lock()
+	q := podSlotQueueLocked(group, podip)
+	if q.running < PodQueueCapacity && q.waiting.Len() == 0 {
+		q.running++
+		podSlotMutex.Unlock()
+		return podip, nil
+	}
+	w := &podWaiter{granted: make(chan string, 1), podip: podip}
+	w.elem = q.waiting.PushBack(w)
+	podSlotMutex.Unlock()
+
+	select {
+	case ip := <-w.granted:
+		return ip, nil
+	case <-ctx.Done():
+	}
+
+	podSlotMutex.Lock()
+	select {
+	case ip := <-w.granted:
+		// 放弃的同时刚好分到了位置，把位置还回去
+		podSlotMutex.Unlock()
+		ReleasePodSlot(ip)
+	default:
+		podSlots[w.podip].waiting.Remove(w.elem)
+		podSlotMutex.Unlock()
+	}
+	return "", ctx.Err()
+}
+
+// pod执行完一个任务：先给自己等待队列里的请求，没有的话从同一个revision等待队列最长的pod那里偷最后一个
+func ReleasePodSlot(podip string) {
+	podSlotMutex.Lock()
+	defer podSlotMutex.Unlock()
+	q, ok := podSlots[podip]
+	if !ok || q.running == 0 {
+		return
+	}
+	if e := q.waiting.Front(); e != nil {
+		q.waiting.Remove(e)
+		e.Value.(*podWaiter).granted <- podip
+		return
+	}
+
+	var victim *podSlotQueue
+	for ip, other := range podSlots {
+		if ip == podip || other.group != q.group || other.waiting.Len() == 0 {
+			continue
+		}
+		if victim == nil || other.waiting.Len() > victim.waiting.Len() {
+			victim = other
+		}
+	}
+	if victim == nil {
+		q.running--
+		return
+	}
+	// 偷队尾的：它在原来的pod上要等得最久
+	e := victim.waiting.Back()
+	victim.waiting.Remove(e)
+	e.Value.(*podWaiter).granted <- podip
+
+	GlobalVarMutex.Lock()
+	StolenJobNum++
+	GlobalVarMutex.Unlock()
+}
@@ -0,0 +1,139 @@
+package shared
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func withWorkStealing(t *testing.T) {
+	t.Helper()
+	oldStealing, oldCapacity := WorkStealing, PodQueueCapacity
+	WorkStealing, PodQueueCapacity = true, 1
+	t.Cleanup(func() {
+		WorkStealing, PodQueueCapacity = oldStealing, oldCapacity
+		ResetState()
+	})
+}
+
+// 在后台排队等位置，返回分到的pod
+func acquireAsync(ctx context.Context, podip string) <-chan string {
+	granted := make(chan string, 1)
+	go func() {
+		ip, err := AcquirePodSlot(ctx, "default/alu-bench-00001", podip)
+		if err != nil {
+			ip = "error: " + err.Error()
+		}
+		granted <- ip
+	}()
+	return granted
+}
+
+// 等到podip的等待队列里有n个请求
+func waitingOn(t *testing.T, podip string, n int) {
+	t.Helper()
+	eventually(t, func() bool {
+		podSlotMutex.Lock()
+		defer podSlotMutex.Unlock()
+		q, ok := podSlots[podip]
+		return ok && q.waiting.Len() == n
+	})
+}
+
+func runningOn(podip string) int {
+	podSlotMutex.Lock()
+	defer podSlotMutex.Unlock()
+	if q, ok := podSlots[podip]; ok {
+		return q.running
+	}
+	return 0
+}
+
+func TestAcquirePodSlot(t *testing.T) {
+	withWorkStealing(t)
+	if ip, err := AcquirePodSlot(context.Background(), "default/alu-bench-00001", "10.0.0.1"); err != nil || ip != "10.0.0.1" {
+		t.Fatalf("AcquirePodSlot() = %q, %v, want 10.0.0.1", ip, err)
+	}
+	if got := runningOn("10.0.0.1"); got != 1 {
+		t.Errorf("running = %d, want 1", got)
+	}
+	ReleasePodSlot("10.0.0.1")
+	if got := runningOn("10.0.0.1"); got != 0 {
+		t.Errorf("running after release = %d, want 0", got)
+	}
+}
+
+// pod空出位置时先给自己等待队列里的请求，占用数不变
+func TestReleaseHandsSlotToWaiter(t *testing.T) {
+	withWorkStealing(t)
+	AcquirePodSlot(context.Background(), "default/alu-bench-00001", "10.0.0.1")
+	granted := acquireAsync(context.Background(), "10.0.0.1")
+	waitingOn(t, "10.0.0.1", 1)
+
+	ReleasePodSlot("10.0.0.1")
+	if ip := <-granted; ip != "10.0.0.1" {
+		t.Errorf("waiter got %q, want 10.0.0.1", ip)
+	}
+	if got := runningOn("10.0.0.1"); got != 1 {
+		t.Errorf("running = %d, want 1", got)
+	}
+}
+
+// 同一个revision里空出来的pod从别的pod的等待队列里偷请求
+func TestReleaseStealsFromOtherPod(t *testing.T) {
+	withWorkStealing(t)
+	AcquirePodSlot(context.Background(), "default/alu-bench-00001", "10.0.0.1")
+	AcquirePodSlot(context.Background(), "default/alu-bench-00001", "10.0.0.2")
+	granted := acquireAsync(context.Background(), "10.0.0.1")
+	waitingOn(t, "10.0.0.1", 1)
+
+	ReleasePodSlot("10.0.0.2")
+	if ip := <-granted; ip != "10.0.0.2" {
+		t.Errorf("waiter got %q, want the idle pod 10.0.0.2", ip)
+	}
+	if StolenJobNum != 1 {
+		t.Errorf("StolenJobNum = %d, want 1", StolenJobNum)
+	}
+}
+
+// 等待中放弃的请求离开等待队列，之后的ReleasePodSlot不会把位置给它
+func TestAcquirePodSlotCancelled(t *testing.T) {
+	withWorkStealing(t)
+	AcquirePodSlot(context.Background(), "default/alu-bench-00001", "10.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	granted := acquireAsync(ctx, "10.0.0.1")
+	waitingOn(t, "10.0.0.1", 1)
+
+	cancel()
+	if ip := <-granted; ip != "error: context canceled" {
+		t.Errorf("cancelled waiter got %q", ip)
+	}
+	waitingOn(t, "10.0.0.1", 0)
+	ReleasePodSlot("10.0.0.1")
+	if got := runningOn("10.0.0.1"); got != 0 {
+		t.Errorf("running after release = %d, want 0", got)
+	}
+}
+
+// 发往pod失败、不会有/store回调时，RollbackDispatch把位置还回去，排在后面的请求能发出去
+func TestRollbackReleasesSlot(t *testing.T) {
+	withWorkStealing(t)
+	AcquirePodSlot(context.Background(), "default/alu-bench-00001", "10.0.0.1")
+	AddReqToRS("10.0.0.1", 100)
+	id := MarkDispatched("fn")
+	granted := acquireAsync(context.Background(), "10.0.0.1")
+	waitingOn(t, "10.0.0.1", 1)
+
+	RollbackDispatch("10.0.0.1", 100, id)
+	select {
+	case ip := <-granted:
+		if ip != "10.0.0.1" {
+			t.Errorf("waiter got %q, want 10.0.0.1", ip)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter still blocked after the failed request was rolled back")
+	}
+	if CheckPodBusy("10.0.0.1") {
+		t.Error("failed request still counted on the pod")
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"knative.dev/serving/pkg/shared"
+)
+
+// NewStoreHandler 处理pod执行完任务后发来的/store回调，main.go把它挂在8081端口上，测试的harness直接调用
+func NewStoreHandler(logger *zap.SugaredLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		bodyNumList := strings.Split(string(body), " ")
+		podip := r.Header.Get("X-PodIP")
+		rate, err := shared.CallbackRate(podip, bodyNumList) // 理论的执行时间
+		if err != nil {
+			http.Error(w, "Malformed callback body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		runTime := shared.RunTimeFromCallback(string(body))
+		shared.ObservePodSpeed(podip, rate, runTime)
+		shared.ReportPodLatency(podip, rate, runTime)
+		if shared.ObservePodWarmup(podip, runTime) {
+			age, firstRunTime := shared.PodWarmupInfo(podip)
+			logger.Infof("Pod %s warmed up after %d requests, age %v, first request took %.0fms",
+				podip, shared.WarmupRequests, age, firstRunTime)
+		}
+		if responseTime, err := strconv.ParseFloat(bodyNumList[1], 64); err == nil {
+			shared.ObserveResponseTime(responseTime)
+		}
+		shared.DelReqFromRS(podip, rate)
+		if shared.WorkStealing {
+			shared.ReleasePodSlot(podip)
+		}
+		shared.MarkCompleted(r.Header.Get("X-Dispatch-ID"))
+
+		// 下面是实验4将任务执行时间添加到全局变量中的代码，实验3中因为知道rate，所以在handler.go的proxyRequest函数做了这个
+		// lat, _ := strconv.ParseFloat(bodyNumList[3], 64)
+		// resp, _ := strconv.ParseFloat(bodyNumList[1], 64)
+		// runningTime := lat - resp
+		// shared.AddJobToGlobalVar(runningTime)
+
+		// fmt.Println("将请求从RS中删除", podip, rate)
+		w.WriteHeader(http.StatusOK)
+		// w.Write([]byte("Request stored"))
+	}
+}
+
+// NewStartHandler 处理pod开始执行任务时发来的/start?id=<X-Dispatch-ID>回调，长任务从这时起才可以被暂停
+func NewStartHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		shared.AckRunning(r.URL.Query().Get("id"))
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// 进程内测试用（knative.dev/serving/pkg/activator/testing）：把activationHandler、WrapActivatorHandlerWithFullDuplex
+// 和自定义队列接成和main.go一样的链，省掉了指标、请求日志和超时这些外层handler。
+// 请求的revision直接放进上下文，不需要ContextHandler和configStore。
+// Throttler由调用者给，net的HarnessThrottler就是一个真正的Throttler；pod用fakepod，挂在PodNetwork上。
+// handler和net的测试都要用，所以不能放在某一个包的_test.go里
+
+package testing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"knative.dev/pkg/logging"
+	tracingconfig "knative.dev/pkg/tracing/config"
+	activatorconfig "knative.dev/serving/pkg/activator/config"
+	"knative.dev/serving/pkg/activator/handler"
+	v1 "knative.dev/serving/pkg/apis/serving/v1"
+	"knative.dev/serving/pkg/networking"
+	"knative.dev/serving/pkg/shared"
+)
+
+var queueOnce sync.Once
+
+type Harness struct {
+	// Handler 接收客户端请求，相当于activator的8012端口
+	Handler http.Handler
+	// Callbacks 接收pod的/store和/start回调，相当于activator的8081端口
+	Callbacks http.Handler
+}
+
+// NewHarness 为rev搭一条handler链，第一次调用时启动自定义队列，队列模式要在这之前设好
+func NewHarness(ctx context.Context, t handler.Throttler, transport http.RoundTripper, rev *v1.Revision) *Harness {
+	logger := logging.FromContext(ctx)
+	queueOnce.Do(func() { go shared.RunQueue() })
+
+	ah := handler.New(ctx, t, transport, false /*usePassthroughLb*/, logger, false /*tlsEnabled*/)
+	ah = handler.WrapActivatorHandlerWithFullDuplex(ah, logger)
+
+	revID := types.NamespacedName{Namespace: rev.Namespace, Name: rev.Name}
+	cfg := &activatorconfig.Config{Tracing: &tracingconfig.Config{Backend: tracingconfig.None}}
+	callbacks := http.NewServeMux()
+	callbacks.HandleFunc("/store", handler.NewStoreHandler(logger))
+	callbacks.HandleFunc("/start", handler.NewStartHandler())
+	return &Harness{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := activatorconfig.ToContext(r.Context(), cfg)
+			ctx = handler.WithRevisionAndID(ctx, rev, revID)
+			ah.ServeHTTP(w, r.WithContext(ctx))
+		}),
+		Callbacks: callbacks,
+	}
+}
+
+// PodNetwork 是假的pod网络：shared按ip区分pod，本地起的httptest服务器却都在127.0.0.1上，
+// 所以每个pod用一个假的ip，连接按ip转到对应的服务器上，不管端口（发到用户容器端口的控制请求也转到同一个pod）
+type PodNetwork struct {
+	mu      sync.Mutex
+	servers map[string]*httptest.Server
+}
+
+func NewPodNetwork() *PodNetwork {
+	return &PodNetwork{servers: make(map[string]*httptest.Server)}
+}
+
+// Add 在ip上起一个pod，返回throttler用的dest（ip:8012）
+func (n *PodNetwork) Add(ip string, pod http.Handler) string {
+	srv := httptest.NewServer(pod)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.servers[ip] = srv
+	return net.JoinHostPort(ip, strconv.Itoa(networking.BackendHTTPPort))
+}
+
+// Remove 停掉ip上的pod，还在上面跑的请求的连接被断开
+func (n *PodNetwork) Remove(ip string) {
+	n.mu.Lock()
+	srv, ok := n.servers[ip]
+	delete(n.servers, ip)
+	n.mu.Unlock()
+	if ok {
+		srv.CloseClientConnections()
+		srv.Close()
+	}
+}
+
+// Close 停掉所有pod
+func (n *PodNetwork) Close() {
+	n.mu.Lock()
+	ips := make([]string, 0, len(n.servers))
+	for ip := range n.servers {
+		ips = append(ips, ip)
+	}
+	n.mu.Unlock()
+	for _, ip := range ips {
+		n.Remove(ip)
+	}
+}
+
+// Transport 返回按假ip连到pod上的RoundTripper，交给NewHarness
+func (n *PodNetwork) Transport() http.RoundTripper {
+	var dialer net.Dialer
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			n.mu.Lock()
+			srv, ok := n.servers[host]
+			n.mu.Unlock()
+			if !ok {
+				return nil, fmt.Errorf("no pod at %s", host)
+			}
+			return dialer.DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+}
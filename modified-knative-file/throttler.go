@@ -18,9 +18,12 @@ package net
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
@@ -45,6 +48,7 @@ import (
 	servinglisters "knative.dev/serving/pkg/client/listers/serving/v1"
 	"knative.dev/serving/pkg/networking"
 	"knative.dev/serving/pkg/queue"
+	"knative.dev/serving/pkg/shared"
 )
 
 const (
@@ -165,9 +169,19 @@ type revisionThrottler struct {
 	// request path. This is: trackers, clusterIPDest.
 	mux sync.RWMutex
 
+	// revision在activator启动前就有了：第一次handleUpdate里的pod是启动前就在跑的，算热的
+	warmOnFirstUpdate bool
+
 	logger *zap.SugaredLogger
 }
 
+// activator的启动时间，以及启动后多久内收到的第一次更新算初始同步。
+// 启动时缩到零的revision之后第一次更新里的pod是冷启动的，不能算热的
+var (
+	activatorStart    = time.Now()
+	initialSyncWindow = 30 * time.Second
+)
+
 func newRevisionThrottler(revID types.NamespacedName,
 	containerConcurrency int, proto string,
 	breakerParams queue.BreakerParams,
@@ -211,6 +225,11 @@ func noop() {}
 // Returns a dest that at the moment of choosing had an open slot
 // for request.
 func (rt *revisionThrottler) acquireDest(ctx context.Context) (func(), *podTracker) {
+	return rt.acquireDestExcluding(ctx, nil)
+}
+
+// 和acquireDest一样，但不考虑exclude中的pod（对冲的副本不能再发回原来的pod）
+func (rt *revisionThrottler) acquireDestExcluding(ctx context.Context, exclude sets.Set[string]) (func(), *podTracker) {
 	rt.mux.RLock()
 	defer rt.mux.RUnlock()
 
@@ -218,14 +237,38 @@ func (rt *revisionThrottler) acquireDest(ctx context.Context) (func(), *podTrack
 		return noop, rt.clusterIPTracker
 	}
 
-	policy := simpleRandomChoice2Policy()
-	// policy := lateRandomChoice2Policy()
+	targets := make([]*podTracker, 0, len(rt.assignedTrackers))
+	for _, t := range rt.assignedTrackers {
+		if !exclude.Has(t.dest) {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 {
+		return noop, nil
+	}
+	// 最近失败过的pod和被异常检测踢出的pod先不选，都不健康的话就不管了
+	healthy := make([]*podTracker, 0, len(targets))
+	for _, t := range targets {
+		if ip := strings.Split(t.dest, ":")[0]; !shared.IsPodSuspect(ip) && !shared.IsPodEjected(ip) {
+			healthy = append(healthy, t)
+		}
+	}
+	if len(healthy) > 0 {
+		targets = healthy
+	}
+
+	// 策略由环境变量LB_POLICY选择，见lbPolicies
+	policy := newLBPolicy()
+	if shared.WarmupAware {
+		policy = warmupAwarePolicy(policy)
+	}
 
-	return policy(ctx, rt.assignedTrackers)
+	return policy(ctx, targets)
 	// return rt.lbPolicy(ctx, rt.assignedTrackers)
 }
 
-func (rt *revisionThrottler) try(ctx context.Context, function func(string) error) error {
+// function的ctx在对冲时是单独一份可取消的上下文，取消表示另一份已经先返回了
+func (rt *revisionThrottler) try(ctx context.Context, function func(context.Context, string) error) error {
 	var ret error
 
 	// Retrying infinitely as long as we receive no dest. Outer semaphore and inner
@@ -235,16 +278,26 @@ func (rt *revisionThrottler) try(ctx context.Context, function func(string) erro
 	for reenqueue {
 		reenqueue = false
 		if err := rt.breaker.Maybe(ctx, func() {
-			cb, tracker := rt.acquireDest(ctx)
-			if tracker == nil {
-				// This can happen if individual requests raced each other or if pod
-				// capacity was decreased after passing the outer semaphore.
-				reenqueue = true
-				return
+			// pod失败的话排除它重新选，见shared.ErrPodFailed
+			exclude := sets.New[string]()
+			for attempt := 0; ; attempt++ {
+				cb, tracker := rt.acquireDestExcluding(ctx, exclude)
+				if tracker == nil {
+					if attempt == 0 {
+						// This can happen if individual requests raced each other or if pod
+						// capacity was decreased after passing the outer semaphore.
+						reenqueue = true
+					}
+					return
+				}
+				ret = rt.tryDest(ctx, cb, tracker, function)
+				if !errors.Is(ret, shared.ErrPodFailed) || attempt >= shared.MaxPodRetries || rt.clusterIPTracker != nil {
+					return
+				}
+				rt.logger.Debugw("Retrying on another pod", zap.String("dest", tracker.dest), zap.Error(ret))
+				shared.CountRetry()
+				exclude.Insert(tracker.dest)
 			}
-			defer cb()
-			// We already reserved a guaranteed spot. So just execute the passed functor.
-			ret = function(tracker.dest)
 		}); err != nil {
 			return err
 		}
@@ -252,6 +305,75 @@ func (rt *revisionThrottler) try(ctx context.Context, function func(string) erro
 	return ret
 }
 
+func (rt *revisionThrottler) tryDest(ctx context.Context, cb func(), tracker *podTracker, function func(context.Context, string) error) error {
+	defer cb()
+	if hedge, _ := ctx.Value(shared.HedgeKey).(bool); hedge && rt.clusterIPTracker == nil {
+		return rt.hedge(ctx, tracker, function)
+	}
+	// We already reserved a guaranteed spot. So just execute the passed functor.
+	return function(ctx, tracker.dest)
+}
+
+// 先发给first，等shared.HedgeDelay()还没返回的话再挑一个pod发一份副本，用先成功的结果，另一份取消；
+// 两份都失败才返回错误。副本发出之前原来那份就失败了的话直接返回，由try换pod重试
+func (rt *revisionThrottler) hedge(ctx context.Context, first *podTracker, function func(context.Context, string) error) error {
+	type result struct {
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2)
+	primaryCtx, cancelPrimary := context.WithCancel(ctx)
+	defer cancelPrimary()
+	go func() {
+		results <- result{err: function(primaryCtx, first.dest), primary: true}
+	}()
+
+	timer := time.NewTimer(shared.HedgeDelay())
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		return res.err
+	case <-timer.C:
+	}
+
+	cb, second := rt.acquireDestExcluding(ctx, sets.New(first.dest))
+	if second == nil {
+		// 没有别的pod可发，只能等原来那份
+		res := <-results
+		return res.err
+	}
+	defer cb()
+	hedgeCtx, cancelHedge := context.WithCancel(ctx)
+	defer cancelHedge()
+	go func() {
+		results <- result{err: function(hedgeCtx, second.dest), primary: false}
+	}()
+
+	var firstErr error
+	for pending := 2; pending > 0; pending-- {
+		res := <-results
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		if res.primary {
+			cancelHedge()
+		} else {
+			cancelPrimary()
+		}
+		shared.CountHedge(!res.primary)
+		// 等输的那份退出，免得它在handler返回之后还在用请求
+		if pending == 2 {
+			<-results
+		}
+		return nil
+	}
+	shared.CountHedge(false)
+	return firstErr
+}
+
 func (rt *revisionThrottler) calculateCapacity(backendCount, numTrackers, activatorCount int) int {
 	targetCapacity := 0
 	if numTrackers > 0 {
@@ -326,6 +448,7 @@ func (rt *revisionThrottler) updateCapacity(backendCount int) {
 		rt.mux.Lock()
 		defer rt.mux.Unlock()
 		rt.assignedTrackers = assigned
+		shared.SetPodNum(rt.revID.String(), len(assigned))
 		return len(assigned)
 	}()
 
@@ -335,6 +458,8 @@ func (rt *revisionThrottler) updateCapacity(backendCount int) {
 
 	rt.backendCount = backendCount
 	rt.breaker.UpdateConcurrency(capacity)
+	// 让自定义队列知道revision是否在从零扩容
+	shared.SetReadyBackends(rt.revID.String(), backendCount)
 }
 
 func (rt *revisionThrottler) updateThrottlerState(backendCount int, trackers []*podTracker, clusterIPDest *podTracker) {
@@ -422,6 +547,8 @@ func (rt *revisionThrottler) handleUpdate(update revisionDestsUpdate) {
 	// ClusterIP is not yet ready, so we want to send requests directly to the pods.
 	// NB: this will not be called in parallel, thus we can build a new podTrackers
 	// array before taking out a lock.
+	initialSync := rt.warmOnFirstUpdate && time.Since(activatorStart) < initialSyncWindow
+	rt.warmOnFirstUpdate = false
 	if update.ClusterIPDest == "" {
 		// Create a map for fast lookup of existing trackers.
 		trackersMap := make(map[string]*podTracker, len(rt.podTrackers))
@@ -430,12 +557,17 @@ func (rt *revisionThrottler) handleUpdate(update revisionDestsUpdate) {
 		}
 
 		trackers := make([]*podTracker, 0, len(update.Dests))
+		podips := make([]string, 0, len(update.Dests))
 
 		// Loop over dests, reuse existing tracker if we have one, otherwise create
 		// a new one.
 		for newDest := range update.Dests {
 			tracker, ok := trackersMap[newDest]
 			if !ok {
+				// 新pod，记下加入时间，冷启动感知的放置据此区分冷热pod；初始同步时已经在的pod不登记，算热的
+				if !initialSync {
+					shared.RegisterPod(strings.Split(newDest, ":")[0])
+				}
 				if rt.containerConcurrency == 0 {
 					tracker = newPodTracker(newDest, nil)
 				} else {
@@ -447,7 +579,10 @@ func (rt *revisionThrottler) handleUpdate(update revisionDestsUpdate) {
 				}
 			}
 			trackers = append(trackers, tracker)
+			podips = append(podips, strings.Split(newDest, ":")[0])
 		}
+		// 记下每个pod属于哪个revision，在途任务按revision汇总
+		shared.SetRevisionPods(rt.revID.String(), podips)
 
 		rt.updateThrottlerState(len(update.Dests), trackers, nil /*clusterIP*/)
 		return
@@ -498,12 +633,25 @@ func NewThrottler(ctx context.Context, ipAddr string) *Throttler {
 			UpdateFunc: controller.PassNew(t.publicEndpointsUpdated),
 		},
 	})
+
+	// private service的Endpoints里是各个pod，记录pod所在的节点，供按节点均衡的lbPolicy使用
+	endpointsInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: reconciler.LabelFilterFunc(networking.ServiceTypeKey,
+			string(networking.ServiceTypePrivate), false),
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    t.privateEndpointsUpdated,
+			UpdateFunc: controller.PassNew(t.privateEndpointsUpdated),
+			DeleteFunc: t.privateEndpointsDeleted,
+		},
+	})
 	return t
 }
 
 // Run starts the throttler and blocks until the context is done.
 func (t *Throttler) Run(ctx context.Context, probeTransport http.RoundTripper, usePassthroughLb bool, meshMode netcfg.MeshCompatibilityMode) {
 	rbm := newRevisionBackendsManager(ctx, probeTransport, usePassthroughLb, meshMode)
+	// 用同一个transport探测pod的实际并发，对账requestStatic
+	go t.probePods(ctx, probeTransport)
 	// Update channel is closed when ctx is done.
 	t.run(rbm.updates())
 }
@@ -524,7 +672,7 @@ func (t *Throttler) run(updateCh <-chan revisionDestsUpdate) {
 }
 
 // Try waits for capacity and then executes function, passing in a l4 dest to send a request
-func (t *Throttler) Try(ctx context.Context, revID types.NamespacedName, function func(string) error) error {
+func (t *Throttler) Try(ctx context.Context, revID types.NamespacedName, function func(context.Context, string) error) error {
 	rt, err := t.getOrCreateRevisionThrottler(revID)
 	if err != nil {
 		return err
@@ -558,6 +706,7 @@ func (t *Throttler) getOrCreateRevisionThrottler(revID types.NamespacedName) (*r
 			queue.BreakerParams{QueueDepth: breakerQueueDepth, MaxConcurrency: revisionMaxConcurrency},
 			t.logger,
 		)
+		revThrottler.warmOnFirstUpdate = rev.CreationTimestamp.Time.Before(activatorStart)
 		t.revisionThrottlers[revID] = revThrottler
 	}
 	return revThrottler, nil
@@ -593,6 +742,7 @@ func (t *Throttler) revisionDeleted(obj interface{}) {
 	t.revisionThrottlersMutex.Lock()
 	defer t.revisionThrottlersMutex.Unlock()
 	delete(t.revisionThrottlers, revID)
+	shared.ForgetRevision(revID.String())
 }
 
 func (t *Throttler) handleUpdate(update revisionDestsUpdate) {
@@ -680,6 +830,31 @@ func (t *Throttler) publicEndpointsUpdated(newObj interface{}) {
 	t.epsUpdateCh <- endpoints
 }
 
+func (t *Throttler) privateEndpointsUpdated(newObj interface{}) {
+	endpoints := newObj.(*corev1.Endpoints)
+	nodes := make(map[string]string)
+	for _, subset := range endpoints.Subsets {
+		for _, addrs := range [][]corev1.EndpointAddress{subset.Addresses, subset.NotReadyAddresses} {
+			for _, addr := range addrs {
+				if addr.NodeName != nil {
+					nodes[addr.IP] = *addr.NodeName
+				}
+			}
+		}
+	}
+	// 缩容后被删掉的pod不再出现在Endpoints里，一并把它的节点记录删掉
+	shared.SetEndpointsPodNodes(endpoints.Namespace+"/"+endpoints.Name, nodes)
+}
+
+func (t *Throttler) privateEndpointsDeleted(obj interface{}) {
+	acc, err := kmeta.DeletionHandlingAccessor(obj)
+	if err != nil {
+		t.logger.Warnw("Private endpoints delete failure to process", zap.Error(err))
+		return
+	}
+	shared.SetEndpointsPodNodes(acc.GetNamespace()+"/"+acc.GetName(), nil)
+}
+
 // minOneOrValue function returns num if its greater than 1
 // else the function returns 1
 func minOneOrValue(num int) int {
@@ -0,0 +1,162 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// 进程内测试用的Throttler：不需要informer和revisionBackendsManager，revision放在内存里的lister中，
+// pod的增减和activator的数量通过假的通道交给真正的run循环处理，和线上走同一条路径。
+// 每次更新都等run循环处理完才返回，场景里“某个时刻加减pod”是确定的
+
+package net
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+
+	"knative.dev/pkg/logging"
+	"knative.dev/serving/pkg/apis/serving"
+	v1 "knative.dev/serving/pkg/apis/serving/v1"
+	servinglisters "knative.dev/serving/pkg/client/listers/serving/v1"
+)
+
+// HarnessThrottler 是一个真正的Throttler，revision和pod由调用者提供
+type HarnessThrottler struct {
+	*Throttler
+	indexer  cache.Indexer
+	updateCh chan revisionDestsUpdate
+}
+
+// NewHarnessThrottler 创建Throttler并启动run循环。ctx结束后run循环退出，之后不能再调用UpdateDests和SetActivators
+func NewHarnessThrottler(ctx context.Context, ipAddr string) *HarnessThrottler {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	h := &HarnessThrottler{
+		Throttler: &Throttler{
+			revisionThrottlers: make(map[types.NamespacedName]*revisionThrottler),
+			revisionLister:     servinglisters.NewRevisionLister(indexer),
+			ipAddress:          ipAddr,
+			logger:             logging.FromContext(ctx),
+			epsUpdateCh:        make(chan *corev1.Endpoints),
+		},
+		indexer:  indexer,
+		updateCh: make(chan revisionDestsUpdate),
+	}
+	go h.run(h.updateCh)
+	go func() {
+		<-ctx.Done()
+		close(h.updateCh)
+	}()
+	return h
+}
+
+// AddRevision 相当于revision informer的AddFunc
+func (h *HarnessThrottler) AddRevision(rev *v1.Revision) error {
+	if err := h.indexer.Add(rev); err != nil {
+		return err
+	}
+	h.revisionUpdated(rev)
+	return nil
+}
+
+// DeleteRevision 相当于revision informer的DeleteFunc
+func (h *HarnessThrottler) DeleteRevision(rev *v1.Revision) error {
+	if err := h.indexer.Delete(rev); err != nil {
+		return err
+	}
+	h.revisionDeleted(rev)
+	return nil
+}
+
+// UpdateDests 把revision的pod换成dests（ip:port），相当于revisionBackendsManager探测到pod的增减。
+// 传空的dests就是缩到零
+func (h *HarnessThrottler) UpdateDests(revID types.NamespacedName, dests ...string) {
+	h.updateCh <- revisionDestsUpdate{Rev: revID, Dests: sets.New(dests...)}
+	h.sync()
+}
+
+// SetActivators 设置public service的Endpoints里有哪些activator，决定这个activator分到哪一片pod。
+// activatorIPs里不包含自己的ip时，这个activator不参与分片
+func (h *HarnessThrottler) SetActivators(revID types.NamespacedName, activatorIPs ...string) error {
+	rt, err := h.getOrCreateRevisionThrottler(revID)
+	if err != nil {
+		return err
+	}
+	addrs := make([]corev1.EndpointAddress, 0, len(activatorIPs))
+	for _, ip := range activatorIPs {
+		addrs = append(addrs, corev1.EndpointAddress{IP: ip})
+	}
+	h.epsUpdateCh <- &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: revID.Namespace,
+			Name:      revID.Name,
+			Labels:    map[string]string{serving.RevisionLabelKey: revID.Name},
+		},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: addrs,
+			Ports:     []corev1.EndpointPort{{Name: rt.protocol}},
+		}},
+	}
+	h.sync()
+	return nil
+}
+
+// run循环一次只处理一个更新，它收下一条（没有revision标签、会被忽略的Endpoints）时，上一条一定已经处理完了
+func (h *HarnessThrottler) sync() {
+	h.epsUpdateCh <- &corev1.Endpoints{}
+}
+
+// NewHarnessRevision 构造一个测试用的revision，cc是containerConcurrency，0表示不限
+func NewHarnessRevision(namespace, name string, cc int64, annotations map[string]string) *v1.Revision {
+	return &v1.Revision{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: annotations,
+		},
+		Spec: v1.RevisionSpec{
+			ContainerConcurrency: &cc,
+		},
+	}
+}
+
+// pod增减之后，Try只会选到当前的pod
+func TestHarnessThrottlerFollowsDests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHarnessThrottler(ctx, "10.1.0.1")
+	rev := NewHarnessRevision("default", "alu-bench-00001", 1, nil)
+	if err := h.AddRevision(rev); err != nil {
+		t.Fatal(err)
+	}
+	revID := types.NamespacedName{Namespace: rev.Namespace, Name: rev.Name}
+
+	for _, dest := range []string{"10.0.0.1:8012", "10.0.0.2:8012"} {
+		h.UpdateDests(revID, dest)
+		var got string
+		if err := h.Try(ctx, revID, func(_ context.Context, d string) error {
+			got = d
+			return nil
+		}); err != nil {
+			t.Fatalf("Try: %v", err)
+		}
+		if got != dest {
+			t.Errorf("Try sent to %q, want %q", got, dest)
+		}
+	}
+}
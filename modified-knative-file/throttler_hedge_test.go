@@ -0,0 +1,97 @@
+// revisionThrottler.hedge的测试：请求走scenario_test.go里的handler链，两个pod，对冲的等待时间用HedgeDefaultDelay
+
+package net
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"knative.dev/serving/pkg/shared"
+)
+
+// 打开对冲：不超过rate 10的请求等delay还没返回就发副本
+func withHedging(t *testing.T, delay time.Duration) {
+	oldRate, oldDelay := shared.HedgeMaxRate, shared.HedgeDefaultDelay
+	t.Cleanup(func() { shared.HedgeMaxRate, shared.HedgeDefaultDelay = oldRate, oldDelay })
+	shared.HedgeMaxRate, shared.HedgeDefaultDelay = 10, delay
+}
+
+func hedgeCounts() (hedged, won int) {
+	shared.GlobalVarMutex.Lock()
+	defer shared.GlobalVarMutex.Unlock()
+	return shared.HedgedJobNum, shared.HedgeWinJobNum
+}
+
+// 过after之后不回复直接断开连接，客户端先断开的话什么也不做
+func failingPod(after time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(after):
+		case <-r.Context().Done():
+			return
+		}
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			conn.Close()
+		}
+	})
+}
+
+// 原来那份卡在慢pod上，过了对冲等待时间副本发到快pod上先返回；慢pod上的那份被取消，它的占用由pod的回调撤销
+func TestHedgeWinsWhenPrimaryStalls(t *testing.T) {
+	withHedging(t, 200*time.Millisecond)
+	env := newScenarioEnv(t, "real-world-hedge-00001", 0)
+	hedged, won := hedgeCounts()
+
+	// 5毫秒放大1000倍是5秒，只有一个pod，原来那份一定发到它上面
+	slow := env.addPod("10.0.11.1", 1000, false)
+	start := time.Now()
+	result := make(chan shared.StepResult)
+	go func() { result <- env.do(5, 0) }()
+	<-env.started
+	// 在对冲等待时间之内加上快pod，副本只能发给它
+	fast := env.addPod("10.0.11.2", 1, false)
+
+	if sr := <-result; !served(sr) {
+		t.Fatalf("got %+v, want served", sr)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("hedged request took %v, the primary was not raced", elapsed)
+	}
+	if fast.Served() != 1 {
+		t.Errorf("fast pod served %d, want 1", fast.Served())
+	}
+	if h, w := hedgeCounts(); h != hedged+1 || w != won+1 {
+		t.Errorf("HedgedJobNum, HedgeWinJobNum grew by %d, %d, want 1, 1", h-hedged, w-won)
+	}
+
+	// 慢pod上的那份没等跑完就停了，说明它的上下文被取消了
+	eventually(t, "loser cancelled", func() bool { return slow.Served() == 1 })
+	eventually(t, "loser's dispatch undone", func() bool { return shared.InflightJobNum(env.rev()) == 0 })
+}
+
+// 两份都失败时返回错误，handler回502，两份的占用都由RollbackDispatch撤销
+func TestHedgeFailsWhenBothCopiesFail(t *testing.T) {
+	withHedging(t, 50*time.Millisecond)
+	env := newScenarioEnv(t, "real-world-hedge-00002", 0)
+	hedged, won := hedgeCounts()
+
+	// 失败得比对冲等待时间晚，原来那份不管发到哪个pod上，副本都会发到另一个
+	env.addHandler("10.0.12.1", failingPod(200*time.Millisecond))
+	env.addHandler("10.0.12.2", failingPod(200*time.Millisecond))
+
+	if sr := env.do(5, 0); sr.Status != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", sr.Status)
+	}
+	if h, w := hedgeCounts(); h != hedged+1 || w != won {
+		t.Errorf("HedgedJobNum, HedgeWinJobNum grew by %d, %d, want 1, 0", h-hedged, w-won)
+	}
+	if got := shared.InflightJobNum(env.rev()); got != 0 {
+		t.Errorf("InflightJobNum = %d, want 0", got)
+	}
+	for _, ip := range []string{"10.0.12.1", "10.0.12.2"} {
+		if !shared.IsPodSuspect(ip) {
+			t.Errorf("%s is not suspect", ip)
+		}
+	}
+}
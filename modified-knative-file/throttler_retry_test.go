@@ -0,0 +1,118 @@
+// revisionThrottler.try换pod重试的测试：请求走scenario_test.go里的handler链，
+// 失败的pod回502，proxyRequest用RollbackDispatch撤销占用之后返回shared.ErrPodFailed
+
+package net
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"knative.dev/serving/pkg/shared"
+)
+
+func withRetries(t *testing.T, n int) {
+	old := shared.MaxPodRetries
+	t.Cleanup(func() { shared.MaxPodRetries = old })
+	shared.MaxPodRetries = n
+}
+
+func retryCount() int {
+	shared.GlobalVarMutex.Lock()
+	defer shared.GlobalVarMutex.Unlock()
+	return shared.RetriedJobNum
+}
+
+// 总是回502的pod，相当于queue-proxy在pod被缩掉时的回复
+type badGatewayPod struct {
+	hits atomic.Int32
+}
+
+func (p *badGatewayPod) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	p.hits.Add(1)
+	http.Error(w, "upstream gone", http.StatusBadGateway)
+}
+
+// 第一个pod回502，换到第二个pod上成功
+func TestRetryOnAnotherPod(t *testing.T) {
+	withRetries(t, 1)
+	env := newScenarioEnv(t, "real-world-retry-00001", 0)
+	retried := retryCount()
+
+	bad := &badGatewayPod{}
+	env.addHandler("10.0.21.1", bad)
+	good := env.addPod("10.0.21.2", 1, false)
+	// 好的pod先标成可疑，第一次一定选到坏的pod；坏的pod失败后只剩好的pod可选
+	shared.MarkPodSuspect("10.0.21.2")
+
+	if sr := env.do(5, 0); !served(sr) {
+		t.Fatalf("got %+v, want served", sr)
+	}
+	if bad.hits.Load() != 1 || good.Served() != 1 {
+		t.Errorf("bad pod hit %d times, good pod served %d, want 1, 1", bad.hits.Load(), good.Served())
+	}
+	if got := retryCount() - retried; got != 1 {
+		t.Errorf("RetriedJobNum grew by %d, want 1", got)
+	}
+	if !shared.IsPodSuspect("10.0.21.1") {
+		t.Error("failed pod is not suspect")
+	}
+	eventually(t, "callback from the good pod", func() bool { return shared.InflightJobNum(env.rev()) == 0 })
+}
+
+// 重试次数比pod多时，每个失败过的pod只试一次，没有别的pod可选就停下
+func TestRetryExcludesFailedPods(t *testing.T) {
+	withRetries(t, 5)
+	env := newScenarioEnv(t, "real-world-retry-00002", 0)
+	retried := retryCount()
+
+	bads := []*badGatewayPod{{}, {}}
+	env.addHandler("10.0.22.1", bads[0])
+	env.addHandler("10.0.22.2", bads[1])
+
+	if sr := env.do(5, 0); sr.Status != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", sr.Status)
+	}
+	for i, bad := range bads {
+		if got := bad.hits.Load(); got != 1 {
+			t.Errorf("pod %d hit %d times, want 1", i, got)
+		}
+	}
+	// 两个pod失败后各重试一次，第二次重试时已经没有pod可选了
+	if got := retryCount() - retried; got != 2 {
+		t.Errorf("RetriedJobNum grew by %d, want 2", got)
+	}
+	if got := shared.InflightJobNum(env.rev()); got != 0 {
+		t.Errorf("InflightJobNum = %d, want 0", got)
+	}
+}
+
+// 重试次数用完了，handler回502，每次失败的占用都已经撤销
+func TestRetriesExhausted(t *testing.T) {
+	withRetries(t, 1)
+	env := newScenarioEnv(t, "real-world-retry-00003", 0)
+	retried := retryCount()
+
+	bads := []*badGatewayPod{{}, {}, {}}
+	for i, bad := range bads {
+		env.addHandler(fmt.Sprintf("10.0.23.%d", i+1), bad)
+	}
+
+	if sr := env.do(5, 0); sr.Status != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", sr.Status)
+	}
+	hits := int32(0)
+	for _, bad := range bads {
+		hits += bad.hits.Load()
+	}
+	if hits != 2 {
+		t.Errorf("pods hit %d times in total, want 2", hits)
+	}
+	if got := retryCount() - retried; got != 1 {
+		t.Errorf("RetriedJobNum grew by %d, want 1", got)
+	}
+	if got := shared.InflightJobNum(env.rev()); got != 0 {
+		t.Errorf("InflightJobNum = %d, want 0", got)
+	}
+}
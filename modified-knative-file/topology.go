@@ -0,0 +1,121 @@
+// 节点拓扑：每个worker节点上跑着自己的redis-server，同一节点上的pod争抢节点的CPU。
+// throttler从private service的Endpoints里拿到pod所在的节点，lbPolicy据此在pod和节点两个层面上均衡积压，
+// 避免把长任务堆到挤在同一个节点上的几个pod上
+
+package shared
+
+import (
+	"sync"
+)
+
+// 比较两个pod时节点上积压的权重（pod自己的积压权重为1）
+var NodeWorkWeight = 0.5
+
+// 预计执行时间不小于这个值（毫秒）的任务算长任务，长任务优先发到长任务少的节点上
+var LargeJobWork = 1000.0
+
+var (
+	podNodeMutex sync.RWMutex
+	podNode      = make(map[string]string)          // pod的ip -> 节点名
+	endpointPods = make(map[string]map[string]bool) // private Endpoints的namespace/name -> 里面的pod ip
+)
+
+func SetPodNode(podip string, node string) {
+	podNodeMutex.Lock()
+	defer podNodeMutex.Unlock()
+	podNode[podip] = node
+}
+
+// 用一个private Endpoints里现在的pod（ip -> 节点名）替换它原来的pod，已经不在里面的pod从podNode里删掉，
+// 除非别的Endpoints里还有同一个ip。nodes为空相当于这个Endpoints被删除了
+func SetEndpointsPodNodes(key string, nodes map[string]string) {
+	podNodeMutex.Lock()
+	defer podNodeMutex.Unlock()
+	pods := make(map[string]bool, len(nodes))
+	for ip, node := range nodes {
+		podNode[ip] = node
+		pods[ip] = true
+	}
+	for ip := range endpointPods[key] {
+		if !pods[ip] && !inOtherEndpointsLocked(key, ip) {
+			delete(podNode, ip)
+		}
+	}
+	if len(pods) == 0 {
+		delete(endpointPods, key)
+	} else {
+		endpointPods[key] = pods
+	}
+}
+
+// 调用者需持有podNodeMutex
+func inOtherEndpointsLocked(key string, podip string) bool {
+	for k, pods := range endpointPods {
+		if k != key && pods[podip] {
+			return true
+		}
+	}
+	return false
+}
+
+func PodNode(podip string) string {
+	podNodeMutex.RLock()
+	defer podNodeMutex.RUnlock()
+	return podNode[podip]
+}
+
+// 调用者需持有requestStatic的锁。pod上在途任务的预计执行时间之和，按pod速度折算
+func podWorkLocked(podip string) float64 {
+	podInfo := requestStatic.Data[podip]
+	return podInfo.work / podInfo.speedOrDefault()
+}
+
+// 调用者需持有requestStatic的锁。pod上的长任务个数
+func podLargeJobsLocked(podip string) int {
+	podInfo := requestStatic.Data[podip]
+	num := 0
+	for i, n := range podInfo.reqs {
+		if JoblenMap[i] >= LargeJobWork {
+			num += n
+		}
+	}
+	return num
+}
+
+// 节点上所有pod的积压和长任务个数。不知道在哪个节点的pod只算它自己
+func nodeLoad(podip string) (float64, int) {
+	node := PodNode(podip)
+	if node == "" {
+		return podWorkLocked(podip), podLargeJobsLocked(podip)
+	}
+	podNodeMutex.RLock()
+	defer podNodeMutex.RUnlock()
+	work, large := 0.0, 0
+	for ip, n := range podNode {
+		if n == node {
+			work += podWorkLocked(ip)
+			large += podLargeJobsLocked(ip)
+		}
+	}
+	return work, large
+}
+
+// 选择两个pod：长任务先比节点上的长任务个数，其余按 pod积压 + NodeWorkWeight*节点积压 比较
+func ChoosePodByNode(podip1 string, podip2 string, rate int) string {
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
+	nodeWork1, large1 := nodeLoad(podip1)
+	nodeWork2, large2 := nodeLoad(podip2)
+	if ExpectedExecTime(rate) >= LargeJobWork && large1 != large2 {
+		if large1 > large2 {
+			return podip2
+		}
+		return podip1
+	}
+	score1 := podWorkLocked(podip1) + NodeWorkWeight*nodeWork1
+	score2 := podWorkLocked(podip2) + NodeWorkWeight*nodeWork2
+	if score1 > score2 {
+		return podip2
+	}
+	return podip1
+}
@@ -0,0 +1,249 @@
+// 可选的预写日志（WAL）：把排队和在途任务的状态追加写到本地文件里，activator重启之后回放日志，
+// 重建requestStatic中每个pod上的任务占用情况，免得调度器以为所有pod都是空的而把还在忙的pod压垮。
+// 重启后客户端连接已经断了，排队中的请求没法恢复，只统计丢了多少。
+// 日志每行一条记录：
+//   A <毫秒时间戳> <podip> <rate>   任务发给了pod（AddReqToRS）
+//   D <毫秒时间戳> <podip> <rate>   pod回调了/store（DelReqFromRS）
+//   Q <毫秒时间戳> <id> <rate>      请求进入自定义队列
+//   S <毫秒时间戳> <id>             请求出队发往pod
+//   X <毫秒时间戳> <id>             请求结束（不管是否发出过）
+
+package shared
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 回放时，发出后超过预计执行时间的这么多倍（再加1分钟）还没回调的任务，认为回调在activator宕机期间丢了
+const walStaleFactor = 2
+
+// 追加这么多条记录之后重写一次日志，只保留在途任务和没结束的请求
+const walCompactEvery = 100000
+
+type walEntry struct {
+	ts   float64
+	rate int
+}
+
+var (
+	walMutex    sync.Mutex
+	walFile     *os.File
+	walWriter   *bufio.Writer
+	walPath     string
+	walAppended = 0
+	walInflight = make(map[string][]walEntry) // 日志视角下每个pod上的在途任务，用于重写日志
+	walPending  = make(map[string]walEntry)   // 本进程里还没结束的请求，按id，重写日志时保留它们的Q记录
+)
+
+type WALReport struct {
+	Restored     int // 恢复到requestStatic中的在途任务数
+	Stale        int // 认为已经跑完、回调丢失而丢弃的在途任务数
+	LostRequests int // 重启前还在排队或正在代理、没能完成的请求数
+}
+
+func (r WALReport) String() string {
+	return fmt.Sprintf("restored=%d stale=%d lostRequests=%d", r.Restored, r.Stale, r.LostRequests)
+}
+
+// 打开日志：先回放已有的记录重建requestStatic，再重写成只含在途任务的日志，之后的状态变化都追加进去。
+// 重启前没结束的请求已经算进了LostRequests，不再写进新日志，免得下次重启重复统计，也免得和本进程的id撞上
+func OpenWAL(path string) (WALReport, error) {
+	report, inflight, err := replayWAL(path)
+	if err != nil {
+		return report, err
+	}
+
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	walPath = path
+	walInflight = inflight
+	walPending = make(map[string]walEntry)
+	if err := rewriteWALLocked(); err != nil {
+		return report, err
+	}
+
+	// 回放出来的在途任务放回requestStatic，此时还不能写日志（它们已经在新日志里了）
+	for podip, entries := range inflight {
+		for _, e := range entries {
+			addReqToRS(podip, e.rate)
+		}
+	}
+	return report, nil
+}
+
+func replayWAL(path string) (WALReport, map[string][]walEntry, error) {
+	var report WALReport
+	inflight := make(map[string][]walEntry)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return report, inflight, nil
+	} else if err != nil {
+		return report, inflight, err
+	}
+	defer f.Close()
+
+	pending := make(map[string]bool) // 还没结束的请求
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break // 没有换行符的最后一行是宕机时只写了一半的记录，整行丢掉
+		} else if err != nil {
+			return report, inflight, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		ts, _ := strconv.ParseFloat(fields[1], 64)
+		switch fields[0] {
+		case "A", "D":
+			if len(fields) < 4 {
+				continue
+			}
+			podip := fields[2]
+			rate, _ := strconv.Atoi(fields[3])
+			if fields[0] == "A" {
+				inflight[podip] = append(inflight[podip], walEntry{ts: ts, rate: rate})
+			} else {
+				inflight[podip] = removeWALEntry(inflight[podip], rate)
+			}
+		case "Q":
+			pending[fields[2]] = true
+		case "X":
+			delete(pending, fields[2])
+		}
+	}
+	report.LostRequests = len(pending)
+
+	now := nowMillis()
+	for podip, entries := range inflight {
+		alive := entries[:0]
+		for _, e := range entries {
+			if now-e.ts > ExpectedExecTime(e.rate)*walStaleFactor+60000 {
+				report.Stale++
+				continue
+			}
+			alive = append(alive, e)
+		}
+		if len(alive) == 0 {
+			delete(inflight, podip)
+			continue
+		}
+		inflight[podip] = alive
+		report.Restored += len(alive)
+	}
+	return report, inflight, nil
+}
+
+// 删掉最早的一条rate相同的记录
+func removeWALEntry(entries []walEntry, rate int) []walEntry {
+	for i, e := range entries {
+		if e.rate == rate {
+			return append(entries[:i], entries[i+1:]...)
+		}
+	}
+	return entries
+}
+
+// 用在途任务和还在排队、代理中的请求重写日志：先写临时文件再rename，避免重写到一半宕机。调用者需持有walMutex
+func rewriteWALLocked() error {
+	tmp := walPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for podip, entries := range walInflight {
+		for _, e := range entries {
+			fmt.Fprintf(w, "A %s %s %d\n", strconv.FormatFloat(e.ts, 'f', -1, 64), podip, e.rate)
+		}
+	}
+	for id, e := range walPending {
+		fmt.Fprintf(w, "Q %s %s %d\n", strconv.FormatFloat(e.ts, 'f', -1, 64), id, e.rate)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, walPath); err != nil {
+		return err
+	}
+
+	if walFile != nil {
+		walFile.Close()
+	}
+	walFile, err = os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		walFile, walWriter = nil, nil
+		return err
+	}
+	walWriter = bufio.NewWriter(walFile)
+	walAppended = 0
+	return nil
+}
+
+// 追加一条记录。没有打开日志时什么也不做
+func walAppend(kind string, args ...string) {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	if walWriter == nil {
+		return
+	}
+	ts := strconv.FormatFloat(nowMillis(), 'f', -1, 64)
+	fmt.Fprintf(walWriter, "%s %s %s\n", kind, ts, strings.Join(args, " "))
+	// 每条都刷到磁盘，activator进程崩溃或者节点掉电都不会丢
+	if err := walWriter.Flush(); err == nil {
+		walFile.Sync()
+	}
+
+	switch kind {
+	case "A":
+		rate, _ := strconv.Atoi(args[1])
+		walInflight[args[0]] = append(walInflight[args[0]], walEntry{ts: nowMillis(), rate: rate})
+	case "D":
+		rate, _ := strconv.Atoi(args[1])
+		walInflight[args[0]] = removeWALEntry(walInflight[args[0]], rate)
+	case "Q":
+		rate, _ := strconv.Atoi(args[1])
+		walPending[args[0]] = walEntry{ts: nowMillis(), rate: rate}
+	case "X":
+		delete(walPending, args[0])
+	}
+
+	walAppended++
+	if walAppended >= walCompactEvery {
+		if err := rewriteWALLocked(); err != nil {
+			fmt.Println("重写WAL失败：", err)
+		}
+	}
+}
+
+func walPodEvent(kind string, podip string, rate int) {
+	walAppend(kind, podip, strconv.Itoa(rate))
+}
+
+func walQueueEvent(kind string, c *Completion, args ...string) {
+	walAppend(kind, append([]string{strconv.FormatUint(c.id, 10)}, args...)...)
+}
+
+func CloseWAL() {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	if walWriter != nil {
+		walWriter.Flush()
+		walFile.Close()
+		walFile, walWriter = nil, nil
+	}
+}
@@ -0,0 +1,125 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 在临时目录里写一份日志，返回路径。测试结束时关掉日志，清掉回放进requestStatic的任务
+func writeTestWAL(t *testing.T, lines ...string) string {
+	t.Helper()
+	t.Cleanup(func() {
+		CloseWAL()
+		ResetState()
+	})
+	path := filepath.Join(t.TempDir(), "activator.wal")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func walLine(kind string, ago float64, args ...string) string {
+	return fmt.Sprintf("%s %f %s\n", kind, nowMillis()-ago, strings.Join(args, " "))
+}
+
+func TestWALReplay(t *testing.T) {
+	path := writeTestWAL(t,
+		walLine("Q", 100, "1", "100"),
+		walLine("S", 90, "1"),
+		walLine("A", 90, "10.0.0.1", "100"),
+		walLine("Q", 80, "2", "100"),
+		walLine("S", 70, "2"),
+		walLine("A", 70, "10.0.0.1", "100"),
+		walLine("D", 10, "10.0.0.1", "100"),
+		walLine("X", 10, "2"),
+	)
+	report, err := OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Restored != 1 || report.Stale != 0 || report.LostRequests != 1 {
+		t.Errorf("report = %v, want restored=1 stale=0 lostRequests=1", report)
+	}
+	if got := requestStatic.Data["10.0.0.1"].jobnum; got != 1 {
+		t.Errorf("jobnum after replay = %d, want 1", got)
+	}
+
+	// 新日志只有在途任务，重启前丢的请求不再写进去
+	CloseWAL()
+	again, _, err := replayWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Restored != 1 || again.LostRequests != 0 {
+		t.Errorf("report of the rewritten log = %v, want restored=1 lostRequests=0", again)
+	}
+}
+
+// 发出太久还没回调的任务认为回调丢了，不再占着pod
+func TestWALStaleEntries(t *testing.T) {
+	stale := ExpectedExecTime(100)*walStaleFactor + 60000 + 1000
+	path := writeTestWAL(t,
+		walLine("A", stale, "10.0.0.1", "100"),
+		walLine("A", 10, "10.0.0.2", "100"),
+	)
+	report, err := OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Restored != 1 || report.Stale != 1 {
+		t.Errorf("report = %v, want restored=1 stale=1", report)
+	}
+	if _, ok := requestStatic.Data["10.0.0.1"]; ok {
+		t.Error("stale job was restored")
+	}
+}
+
+// 重写日志时还在排队的请求要留下Q记录，否则重启后统计不到它们
+func TestWALCompactionKeepsPending(t *testing.T) {
+	path := writeTestWAL(t)
+	if _, err := OpenWAL(path); err != nil {
+		t.Fatal(err)
+	}
+	walAppend("Q", "1", "100")
+	walAppend("Q", "2", "100")
+	walPodEvent("A", "10.0.0.1", 100)
+	walAppend("X", "2")
+	walMutex.Lock()
+	err := rewriteWALLocked()
+	walMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	CloseWAL()
+
+	report, _, err := replayWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Restored != 1 || report.LostRequests != 1 {
+		t.Errorf("report after compaction = %v, want restored=1 lostRequests=1", report)
+	}
+}
+
+// 宕机时只写了一半的最后一行整行丢掉，不能把"100"截成"10"当成另一个任务回放
+func TestWALTornLastLine(t *testing.T) {
+	torn := walLine("A", 10, "10.0.0.1", "100")
+	path := writeTestWAL(t,
+		walLine("A", 10, "10.0.0.1", "100"),
+		torn[:len(torn)-2],
+	)
+	report, err := OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Restored != 1 {
+		t.Errorf("report = %v, want restored=1", report)
+	}
+	if got := requestStatic.Data["10.0.0.1"].ratesum; got != 100 {
+		t.Errorf("ratesum = %d, want 100", got)
+	}
+}
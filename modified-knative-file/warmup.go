@@ -0,0 +1,69 @@
+// 冷启动感知的放置：新加入的pod没有历史记录，可能还在预热缓存、建立Redis连接，第一批请求会明显偏慢。
+// 记下pod加入的时间和第一个请求的执行时间，pod执行完WarmupRequests个请求之前算冷的：
+// 小任务优先发给冷pod，相当于替它预热；长任务留在已经热起来的pod上
+
+package shared
+
+import (
+	"time"
+)
+
+// pod执行完这么多个请求才算热起来
+var WarmupRequests = 5
+
+// 预计执行时间不超过这个值（毫秒）的任务算小任务，可以拿来预热冷pod
+var WarmupProbeWork = 200.0
+
+// 是否使用冷启动感知的放置，由main.go根据环境变量WARMUP_AWARE设置
+var WarmupAware = false
+
+// throttler为新的pod创建podTracker时调用
+func RegisterPod(podip string) {
+	requestStatic.Lock()
+	defer requestStatic.Unlock()
+	podInfo := requestStatic.Data[podip]
+	// ip可能被新pod复用，重新开始计
+	podInfo.addedAt = time.Now()
+	podInfo.served = 0
+	podInfo.firstRunTime = 0
+	requestStatic.Data[podip] = podInfo
+}
+
+// /store收到回调时调用，pod刚好热起来时返回true
+func ObservePodWarmup(podip string, runTime float64) bool {
+	requestStatic.Lock()
+	defer requestStatic.Unlock()
+	podInfo, ok := requestStatic.Data[podip]
+	if !ok {
+		return false
+	}
+	if podInfo.served == 0 {
+		podInfo.firstRunTime = runTime
+	}
+	podInfo.served++
+	requestStatic.Data[podip] = podInfo
+	return !podInfo.addedAt.IsZero() && podInfo.served == WarmupRequests
+}
+
+// 没登记过的pod（比如activator启动前就在的）算热的
+func IsPodWarm(podip string) bool {
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
+	podInfo := requestStatic.Data[podip]
+	return podInfo.addedAt.IsZero() || podInfo.served >= WarmupRequests
+}
+
+// pod加入了多久，以及第一个请求的执行时间（毫秒），用于日志
+func PodWarmupInfo(podip string) (time.Duration, float64) {
+	requestStatic.RLock()
+	defer requestStatic.RUnlock()
+	podInfo := requestStatic.Data[podip]
+	if podInfo.addedAt.IsZero() {
+		return 0, podInfo.firstRunTime
+	}
+	return time.Since(podInfo.addedAt), podInfo.firstRunTime
+}
+
+func IsWarmupProbe(rate int) bool {
+	return ExpectedExecTime(rate) <= WarmupProbeWork
+}
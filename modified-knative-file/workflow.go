@@ -0,0 +1,323 @@
+// 函数链（sequence）的工作流引擎：把一个sequence表示成action组成的DAG（链、扇出/扇入），
+// 每个action作为一个独立请求经EnqueueReq进入自定义队列、再经throttler调度到pod上，
+// 前驱action的输出传给后继，最后汇总成结构化的结果（包括端到端的sequence延迟）
+
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 单个action的超时时间，和原来real-world分支里的写法保持一致
+const WorkflowStepTimeout = 320 * time.Second
+
+type WorkflowStep struct {
+	Index int
+	Rate  int     // 理论执行时间，即X-Rate
+	Delay float64 // 前驱全部完成后，再等待多少毫秒才发出（即采样得到的IAT）
+	Deps  []int   // 前驱action的下标
+}
+
+type Workflow struct {
+	ID    string
+	Steps []*WorkflowStep
+
+	succs [][]int // 后继action的下标，由deps反推
+}
+
+type StepResult struct {
+	Index     int     `json:"index"`
+	Rate      int     `json:"rate"`
+	Output    string  `json:"output"`
+	Outcome   string  `json:"outcome"` // 见Outcome.String()，只有served才有Output
+	Status    int     `json:"status"`  // pod（或activator自己）给出的状态码
+	TimedOut  bool    `json:"timed_out"`
+	StartTime float64 `json:"start_time"` // 毫秒时间戳，进入队列的时刻
+	EndTime   float64 `json:"end_time"`   // 毫秒时间戳，拿到返回的时刻
+}
+
+type WorkflowResult struct {
+	ID         string       `json:"id"`
+	Steps      []StepResult `json:"steps"`
+	StartTime  float64      `json:"start_time"`
+	EndTime    float64      `json:"end_time"`
+	SeqLatency float64      `json:"seq_lat"` // 端到端的sequence延迟（毫秒）
+	Failed     int          `json:"failed"`  // 没有成功的action数量（超时、被拒绝、取消或者pod返回了错误）
+}
+
+var (
+	workflowIDMutex sync.Mutex
+	workflowID      = 0
+)
+
+func nextWorkflowID() string {
+	workflowIDMutex.Lock()
+	defer workflowIDMutex.Unlock()
+	workflowID++
+	return "seq-" + strconv.Itoa(workflowID)
+}
+
+func nowMillis() float64 {
+	return float64(time.Now().UnixNano()) / float64(time.Millisecond)
+}
+
+// 检查deps：下标必须在范围内且不能依赖自己，整个图不能有环（否则RunWorkflow里的action会互相等待，永远不结束）
+func NewWorkflow(steps []*WorkflowStep) (*Workflow, error) {
+	n := len(steps)
+	succs := make([][]int, n)
+	indegree := make([]int, n)
+	for i, s := range steps {
+		for _, d := range s.Deps {
+			if d < 0 || d >= n {
+				return nil, fmt.Errorf("workflow step %d: dependency %d out of range [0, %d)", i, d, n)
+			}
+			if d == i {
+				return nil, fmt.Errorf("workflow step %d depends on itself", i)
+			}
+			succs[d] = append(succs[d], i)
+			indegree[i]++
+		}
+	}
+	// 拓扑排序，排不完的就是在环上
+	ready := make([]int, 0, n)
+	for i := range steps {
+		if indegree[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	visited := 0
+	for len(ready) > 0 {
+		j := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		visited++
+		for _, s := range succs[j] {
+			if indegree[s]--; indegree[s] == 0 {
+				ready = append(ready, s)
+			}
+		}
+	}
+	if visited < n {
+		return nil, fmt.Errorf("workflow has a dependency cycle among %d steps", n-visited)
+	}
+
+	for i, s := range steps {
+		s.Index = i
+	}
+	return &Workflow{ID: nextWorkflowID(), Steps: steps, succs: succs}, nil
+}
+
+// 内置的几种结构由代码生成，deps一定合法
+func mustWorkflow(steps []*WorkflowStep) *Workflow {
+	wf, err := NewWorkflow(steps)
+	if err != nil {
+		panic(err)
+	}
+	return wf
+}
+
+// 链式sequence：第i个action依赖第i-1个
+func NewChainWorkflow(rates []int, iats []float64) *Workflow {
+	steps := make([]*WorkflowStep, len(rates))
+	for i, rate := range rates {
+		steps[i] = &WorkflowStep{Rate: rate}
+		if i > 0 {
+			steps[i].Deps = []int{i - 1}
+			steps[i].Delay = iats[i-1]
+		}
+	}
+	return mustWorkflow(steps)
+}
+
+// 扇出/扇入：第一个action完成后并行执行中间的width个action，全部完成后再执行最后一个
+func NewFanOutWorkflow(rates []int, iats []float64) *Workflow {
+	if len(rates) < 3 {
+		return NewChainWorkflow(rates, iats)
+	}
+	last := len(rates) - 1
+	steps := make([]*WorkflowStep, len(rates))
+	steps[0] = &WorkflowStep{Rate: rates[0]}
+	mids := make([]int, 0, last-1)
+	for i := 1; i < last; i++ {
+		steps[i] = &WorkflowStep{Rate: rates[i], Deps: []int{0}, Delay: iats[0]}
+		mids = append(mids, i)
+	}
+	steps[last] = &WorkflowStep{Rate: rates[last], Deps: mids, Delay: iats[last-1]}
+	return mustWorkflow(steps)
+}
+
+// 按real-world的CDF采样一个sequence：长度、平均IAT和CV每个sequence摇一次，每个action的时长和IAT单独摇
+func NewSampledWorkflow(shape string) *Workflow {
+	seqlen := GetSeqLen()
+	if seqlen < 1 {
+		seqlen = 1
+	}
+	seqAvgIAT := GetRandAvgIAT()
+	seqCV := GetRandCV()
+
+	rates := make([]int, seqlen)
+	iats := make([]float64, seqlen)
+	for i := 0; i < seqlen; i++ {
+		rates[i] = GetRandZipf() // GetRandExecTime() / 10
+		iats[i] = GetSeqIAT(seqAvgIAT, seqCV)
+	}
+	iats[seqlen-1] = 0
+
+	if shape == "fanout" {
+		return NewFanOutWorkflow(rates, iats)
+	}
+	return NewChainWorkflow(rates, iats)
+}
+
+// 按trace回放时，负载生成器在X-Trace-Rate里给出这次调用的执行时间（毫秒），trace里没有链的信息，sequence就只有这一个action
+func NewTraceWorkflow(rate int) *Workflow {
+	return NewChainWorkflow([]int{rate}, []float64{0})
+}
+
+// 从下标i开始（含i）沿最长路径还剩多少预计执行时间，用来让调度器知道整条链的剩余工作量
+func (wf *Workflow) RemainingWork(i int) float64 {
+	memo := make(map[int]float64)
+	var walk func(int) float64
+	walk = func(j int) float64 {
+		if v, ok := memo[j]; ok {
+			return v
+		}
+		best := 0.0
+		for _, s := range wf.succs[j] {
+			if v := walk(s); v > best {
+				best = v
+			}
+		}
+		memo[j] = ExpectedExecTime(wf.Steps[j].Rate) + best
+		return memo[j]
+	}
+	return walk(i)
+}
+
+// 没有后继的action就是sink，它负责带上X-Seq-Start-Time让pod算seq_lat
+func (wf *Workflow) isSink(i int) bool {
+	return len(wf.succs[i]) == 0
+}
+
+// 一个任务的预计执行时间：ALU按JoblenMapALU，real-world按所在组的数学期望
+func ExpectedExecTime(rate int) float64 {
+	if t, ok := JoblenMapALU[rate]; ok {
+		return float64(t)
+	}
+	index := GetGroupIndex(rate)
+	if index == -1 {
+		return float64(rate)
+	}
+	return JoblenMap[index]
+}
+
+// 执行整个工作流，阻塞直到所有action完成或超时。每个action都克隆一次原始请求，
+// 用ResponseRecorder接住返回内容（因为原始的ResponseWriter只能用于整个sequence）
+func RunWorkflow(h http.Handler, r *http.Request, wf *Workflow) *WorkflowResult {
+	n := len(wf.Steps)
+	res := &WorkflowResult{ID: wf.ID, Steps: make([]StepResult, n), StartTime: nowMillis()}
+	seqStartTime := strconv.FormatFloat(res.StartTime, 'f', -1, 64)
+
+	finished := make([]chan struct{}, n)
+	for i := range finished {
+		finished[i] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for i := range wf.Steps {
+		wg.Add(1)
+		go func(step *WorkflowStep) {
+			defer wg.Done()
+			defer close(finished[step.Index])
+
+			// 等所有前驱完成，把它们的输出拼起来作为本action的输入
+			inputs := make([]string, 0, len(step.Deps))
+			for _, d := range step.Deps {
+				<-finished[d]
+				inputs = append(inputs, strings.TrimSpace(res.Steps[d].Output))
+			}
+			time.Sleep(time.Duration(step.Delay) * time.Millisecond)
+
+			newReq := r.Clone(r.Context())
+			recorder := httptest.NewRecorder()
+
+			newReq.Header.Set("X-Rate", strconv.Itoa(step.Rate))
+			newReq.Header.Set("X-Arrive-Timestamp", strconv.FormatFloat(nowMillis(), 'f', -1, 64))
+			newReq.Header.Set("X-Last-Rate", "")
+			newReq.Header.Set("X-Seq-ID", wf.ID)
+			newReq.Header.Set("X-Seq-Step", strconv.Itoa(step.Index))
+			newReq.Header.Set("X-Seq-Remaining", strconv.FormatFloat(wf.RemainingWork(step.Index), 'f', -1, 64))
+			if len(inputs) > 0 {
+				newReq.Header.Set("X-Step-Input", strings.Join(inputs, ";"))
+			}
+			if wf.isSink(step.Index) {
+				newReq.Header.Set("X-Seq-Start-Time", seqStartTime)
+			} else {
+				newReq.Header.Set("X-Seq-Start-Time", "0")
+			}
+
+			sr := StepResult{Index: step.Index, Rate: step.Rate, StartTime: nowMillis()}
+			// 每个action一个截止时间，排队、代理都受它约束
+			ctx, cancel := context.WithDeadline(newReq.Context(), RequestDeadline(newReq, WorkflowStepTimeout))
+			defer cancel()
+			done := NewCompletion(recorder)
+			EnqueueReq(h, done.Writer(), newReq.WithContext(ctx), done)
+
+			select {
+			case <-done.Done():
+			case <-ctx.Done():
+			}
+			outcome, _ := done.Abandon()
+			sr.Outcome = outcome.String()
+			sr.Status = recorder.Code
+			switch {
+			case outcome == OutcomeTimedOut:
+				fmt.Println("###sequence", wf.ID, "的第", step.Index, "个任务整体超时")
+				sr.TimedOut = true
+			case outcome == OutcomeServed && recorder.Code < http.StatusBadRequest:
+				sr.Output = recorder.Body.String()
+			default:
+				// 503之类的错误内容不能当成输出传给后继
+				fmt.Println("###sequence", wf.ID, "的第", step.Index, "个任务失败：", outcome, recorder.Code)
+			}
+			sr.EndTime = nowMillis()
+			res.Steps[step.Index] = sr
+		}(wf.Steps[i])
+	}
+	wg.Wait()
+	ForgetSeq(wf.ID)
+
+	res.EndTime = nowMillis()
+	res.SeqLatency = res.EndTime - res.StartTime
+	for _, sr := range res.Steps {
+		if !sr.succeeded() {
+			res.Failed++
+		}
+	}
+	return res
+}
+
+func (sr StepResult) succeeded() bool {
+	return sr.Outcome == OutcomeServed.String() && sr.Status < http.StatusBadRequest
+}
+
+// 把结果写回客户端。要JSON就给结构化结果，否则和原来一样逐行输出每个action的返回内容
+func (res *WorkflowResult) WriteTo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Seq-ID", res.ID)
+	w.Header().Set("X-Seq-Latency", strconv.FormatFloat(res.SeqLatency, 'f', -1, 64))
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	for _, sr := range res.Steps {
+		fmt.Fprint(w, sr.Output)
+	}
+}
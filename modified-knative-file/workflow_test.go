@@ -0,0 +1,64 @@
+package shared
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewWorkflowValidatesDeps(t *testing.T) {
+	tests := []struct {
+		name    string
+		deps    [][]int
+		wantErr bool
+	}{
+		{"chain", [][]int{nil, {0}, {1}}, false},
+		{"fan-out", [][]int{nil, {0}, {0}, {1, 2}}, false},
+		{"out of range", [][]int{nil, {3}}, true},
+		{"negative", [][]int{{-1}}, true},
+		{"self", [][]int{nil, {1}}, true},
+		{"cycle", [][]int{{2}, {0}, {1}}, true},
+		{"cycle behind a root", [][]int{nil, {0, 2}, {1}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := make([]*WorkflowStep, len(tt.deps))
+			for i, deps := range tt.deps {
+				steps[i] = &WorkflowStep{Rate: 100, Deps: deps}
+			}
+			wf, err := NewWorkflow(steps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewWorkflow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(wf.succs) != len(steps) {
+				t.Errorf("succs has %d entries, want %d", len(wf.succs), len(steps))
+			}
+		})
+	}
+}
+
+// 返回503的action不能当成成功，也不能把错误内容当成输出传给后继
+func TestRunWorkflowCountsFailedSteps(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Seq-Step") == "0" {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("done\n"))
+	})
+	wf, err := NewWorkflow([]*WorkflowStep{{Rate: 1}, {Rate: 1, Deps: []int{0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := RunWorkflow(h, httptest.NewRequest(http.MethodGet, "/", nil), wf)
+
+	if res.Failed != 1 {
+		t.Errorf("Failed = %d, want 1", res.Failed)
+	}
+	if got := res.Steps[0]; got.Output != "" || got.Status != http.StatusServiceUnavailable || got.Outcome != "served" {
+		t.Errorf("step 0 = %+v, want no output and status 503", got)
+	}
+	if got := res.Steps[1].Output; got != "done\n" {
+		t.Errorf("step 1 output = %q, want %q", got, "done\n")
+	}
+}
@@ -13,16 +13,43 @@ import time
 import os
 import requests
 import random
+import threading
 from flask import Flask, request
 
 app = Flask(__name__)
 
+# 协作式抢占：activator可以通过/preempt暂停正在执行的任务，/resume让它继续，任务用X-Dispatch-ID标识。
+# 每个任务一个Event，set表示可以运行；alu()每执行一个单位检查一次
+jobs = {}
+jobs_lock = threading.Lock()
+# 暂停超过这么多秒activator还没来恢复，就自己继续，免得activator挂了任务永远卡住
+max_pause = float(os.getenv('PREEMPT_MAX_PAUSE', '10'))
+
+# 任务开始执行时回调activator的/start（和/store是同一个地址），长任务从这时起才会被暂停。
+# 另起线程发，不耽误任务本身；发失败了只是这个任务不会被暂停
+def ack_start(dispatch_id):
+    node_of_activator = os.getenv('NODE_OF_ACTIVATOR')
+    start_url = f'http://172.18.0.{node_of_activator}:30001/start'
+    def post():
+        try:
+            requests.post(start_url, params={'id': dispatch_id}, timeout=1)
+        except requests.exceptions.RequestException:
+            pass
+    threading.Thread(target=post, daemon=True).start()
+
+def wait_if_paused(job):
+    if job is not None and not job.is_set():
+        job.wait(max_pause)
+        job.set()
+
 # 原本是用多线程分摊执行次数times，但是考虑到每个pod只分配单核，这里不妨去掉多线程的写法
-def alu(times):
+def alu(times, job=None):
     a = random.randint(10, 100)
     b = random.randint(10, 100)
     temp = 0
     for i in range(times * 25000):
+        if i % 25000 == 0:
+            wait_if_paused(job)
         if i % 4 == 0:
             temp = a + b
         elif i % 4 == 1:
@@ -49,8 +76,21 @@ def handle_request():
     route_time = float(route_time_str)
     arrive_time = float(arrive_time_str)
     
+    dispatch_id = request.headers.get('X-Dispatch-ID', '')
+    job = threading.Event()
+    job.set()
+    if dispatch_id:
+        with jobs_lock:
+            jobs[dispatch_id] = job
+        ack_start(dispatch_id)
+
     start_time = time.time() * 1000
-    alu(rate)
+    try:
+        alu(rate, job)
+    finally:
+        if dispatch_id:
+            with jobs_lock:
+                jobs.pop(dispatch_id, None)
     end_time = time.time() * 1000
     
     jct = end_time - route_time # 任务发往pod到执行结束
@@ -64,13 +104,34 @@ def handle_request():
     node_of_activator = os.getenv('NODE_OF_ACTIVATOR')
     activator_url = f'http://172.18.0.{node_of_activator}:30001/store'
     try:
-        headers = {'X-PodIP': socket.gethostbyname(socket.gethostname())}
+        headers = {'X-PodIP': socket.gethostbyname(socket.gethostname()),
+                   'X-Dispatch-ID': request.headers.get('X-Dispatch-ID', '')}
         response = requests.post(activator_url, data=ret, headers=headers)
         response.raise_for_status()
     except requests.exceptions.RequestException as e:
         return f"{ret} 无法将任务信息发给activator {activator_url}：{e}"
     return ret
 
+def control_job(pause):
+    job_id = request.args.get('id', '')
+    with jobs_lock:
+        job = jobs.get(job_id)
+    if job is None:
+        return "no such job", 404
+    if pause:
+        job.clear()
+    else:
+        job.set()
+    return "ok"
+
+@app.route('/preempt', methods=['POST'])
+def preempt():
+    return control_job(True)
+
+@app.route('/resume', methods=['POST'])
+def resume():
+    return control_job(False)
+
 if __name__ == "__main__":
     # 监听所有接口（0.0.0.0），端口8080
     app.run(host='0.0.0.0', port=8080)
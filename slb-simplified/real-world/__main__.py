@@ -17,10 +17,29 @@ import utils
 import socket
 import requests
 import random
+import threading
 from flask import Flask, request
 
 app = Flask(__name__)
 
+# 协作式抢占：activator可以通过/preempt暂停正在执行的任务，/resume让它继续，任务用X-Dispatch-ID标识
+jobs = {}
+jobs_lock = threading.Lock()
+# 暂停超过这么多秒activator还没来恢复，就自己继续
+max_pause = float(os.getenv('PREEMPT_MAX_PAUSE', '10'))
+
+# 任务开始执行时回调activator的/start（和/store是同一个地址），长任务从这时起才会被暂停。
+# 另起线程发，不耽误任务本身；发失败了只是这个任务不会被暂停
+def ack_start(dispatch_id):
+    node_of_activator = os.getenv('NODE_OF_ACTIVATOR')
+    start_url = f'http://172.18.0.{node_of_activator}:30001/start'
+    def post():
+        try:
+            requests.post(start_url, params={'id': dispatch_id}, timeout=1)
+        except requests.exceptions.RequestException:
+            pass
+    threading.Thread(target=post, daemon=True).start()
+
 global memCDFFilename, execCDFFilename
 memCDFFilename  = "CDFs/memCDF.csv"
 execCDFFilename = "CDFs/execTimeCDF.csv"
@@ -32,10 +51,10 @@ def mallocRandMem():
     call(["./function","%s" %randMem])
     return randMem
 
-def execRandTime(mmExecTime, randExecTime):
+def execRandTime(mmExecTime, randExecTime, job=None):
     exactAluTime = randExecTime - mmExecTime # 单位都是毫秒。这么做是因为内存操作和计算加起来才是csv文件中的所谓执行时间
     if exactAluTime > 0:
-        utils.alu(exactAluTime)
+        utils.alu(exactAluTime, job, max_pause)
     return randExecTime
 
 @app.route('/', methods=['GET'])
@@ -62,7 +81,19 @@ def main():
     mmEndTime = utils.getTime()
     
     mmExecTime = mmEndTime - mmStartTime
-    execRandTime(mmExecTime, randExecTime)
+    dispatch_id = request.headers.get('X-Dispatch-ID', '')
+    job = threading.Event()
+    job.set()
+    if dispatch_id:
+        with jobs_lock:
+            jobs[dispatch_id] = job
+        ack_start(dispatch_id)
+    try:
+        execRandTime(mmExecTime, randExecTime, job)
+    finally:
+        if dispatch_id:
+            with jobs_lock:
+                jobs.pop(dispatch_id, None)
     
     end_time = time.time() * 1000
     response_time = start_time - arrive_time
@@ -78,7 +109,8 @@ def main():
     node_of_activator = os.getenv('NODE_OF_ACTIVATOR')
     activator_url = f'http://172.18.0.{node_of_activator}:30001/store'
     try:
-        headers = {'X-PodIP': socket.gethostbyname(socket.gethostname())}
+        headers = {'X-PodIP': socket.gethostbyname(socket.gethostname()),
+                   'X-Dispatch-ID': request.headers.get('X-Dispatch-ID', '')}
         response = requests.post(activator_url, data=ret, headers=headers)
         response.raise_for_status()
     except requests.exceptions.RequestException as e:
@@ -86,6 +118,27 @@ def main():
     return ret
 
 
+def control_job(pause):
+    job_id = request.args.get('id', '')
+    with jobs_lock:
+        job = jobs.get(job_id)
+    if job is None:
+        return "no such job", 404
+    if pause:
+        job.clear()
+    else:
+        job.set()
+    return "ok"
+
+@app.route('/preempt', methods=['POST'])
+def preempt():
+    return control_job(True)
+
+@app.route('/resume', methods=['POST'])
+def resume():
+    return control_job(False)
+
+
 if __name__ == '__main__':
     # 监听所有接口（0.0.0.0），端口8080
     app.run(host='0.0.0.0', port=8080)
@@ -34,13 +34,20 @@ def binarySearch(nums, target):
 def getTime():
     return int(round(time.process_time() * 1000))
 
-def alu(times):
+# job是协作式抢占用的threading.Event，没有set时暂停，最多暂停maxPause秒。
+# getTime()是整个进程的CPU时间，暂停期间别的线程用掉的CPU时间要扣掉
+def alu(times, job=None, maxPause=10):
     startTime = getTime()
     base = 10000
     a = random.randint(10, 100)
     b = random.randint(10, 100)
     temp = 0
     while True:
+        if job is not None and not job.is_set():
+            pauseStart = getTime()
+            job.wait(maxPause)
+            job.set()
+            startTime += getTime() - pauseStart
         for i in range(base):
             if i % 4 == 0:
                 temp = a + b